@@ -0,0 +1,94 @@
+// accesslog.go - log requests in JSON.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessEntry is a record of access log.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	SlugOK     bool      `json:"slug_ok"`
+	RemoteAddr string    `json:"remote_addr"`
+	Duration   float64   `json:"duration"`
+}
+
+type accessEntryKey struct{}
+
+// accessLog writes an entry per request to w as a line of JSON.
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAccessLog(w io.Writer) *accessLog {
+	if w == nil {
+		return nil
+	}
+	return &accessLog{w: w}
+}
+
+func (al *accessLog) write(e *accessEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.w.Write(append(b, '\n'))
+}
+
+// handler logs requests to h. The entry is written even if h panics.
+func (al *accessLog) handler(h http.Handler) http.Handler {
+	if al == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e := &accessEntry{
+			Time:       time.Now().UTC(),
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			RemoteAddr: req.RemoteAddr,
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			e.Status = sw.status
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			e.Bytes = sw.written
+			e.Duration = time.Since(e.Time).Seconds()
+			al.write(e)
+		}()
+		h.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), accessEntryKey{}, e)))
+	})
+}
+
+// slugPassed marks access log entries of requests to h as ones
+// that passed the slug check.
+func (al *accessLog) slugPassed(h http.Handler) http.Handler {
+	if al == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if e, ok := req.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+			e.SlugOK = true
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,50 @@
+// auth.go - HTTP authentication of clients.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// equal compares a and b in constant time. Hashes are compared so
+// that length of b isn't revealed either.
+func equal(a, b string) int {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:])
+}
+
+func checkBasicAuth(req *http.Request, user, password string) bool {
+	u, pw, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare both to not reveal which one is wrong
+	uok := equal(user, u)
+	pwok := equal(password, pw)
+	return uok&pwok == 1
+}
+
+// basicAuthHandler requires requests to h to carry user and password.
+// Responses to wrong credentials are delayed by throttle.
+func basicAuthHandler(h http.Handler, user, password string, throttle *missThrottle) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !checkBasicAuth(req, user, password) {
+			// Browsers ask for credentials only after the first try
+			if req.Header.Get("Authorization") != "" {
+				throttle.wait()
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="onionize", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
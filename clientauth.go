@@ -0,0 +1,111 @@
+// clientauth.go - onion client authorization.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"github.com/nogoegst/bulb"
+)
+
+// Tor encodes x25519 keys in unpadded base32.
+var clientAuthEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// validateClientAuthKey checks that key is a base32-encoded
+// x25519 public key.
+func validateClientAuthKey(key string) error {
+	b, err := clientAuthEncoding.DecodeString(strings.ToUpper(key))
+	if err != nil {
+		return fmt.Errorf("Invalid client authorization key %q: %v", key, err)
+	}
+	if _, err := ecdh.X25519().NewPublicKey(b); err != nil {
+		return fmt.Errorf("Invalid client authorization key %q: %v", key, err)
+	}
+	return nil
+}
+
+type clientAuthKey struct {
+	public  string
+	private string
+}
+
+// generateClientAuth generates x25519 key pair of a client.
+func generateClientAuth() (*clientAuthKey, error) {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &clientAuthKey{
+		public:  clientAuthEncoding.EncodeToString(sk.PublicKey().Bytes()),
+		private: clientAuthEncoding.EncodeToString(sk.Bytes()),
+	}, nil
+}
+
+// authPrivate returns line of .auth_private file for onionID,
+// which clients put into their ClientOnionAuthDir.
+func (k *clientAuthKey) authPrivate(onionID string) string {
+	return fmt.Sprintf("%s:descriptor:x25519:%s", onionID, k.private)
+}
+
+// isV2Key reports whether onion key is (or, if it is nil, will
+// be generated as) a v2 one.
+func isV2Key(key crypto.PrivateKey, keyType string) bool {
+	v2 := keyType == KeyTypeRSA1024
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		v2 = true
+	case *bulb.OnionPrivateKey:
+		v2 = k.KeyType != torKeyTypeED25519V3
+	}
+	return v2
+}
+
+// checkClientAuthKey checks that onion key supports v3 client
+// authorization (i.e. it is not a v2 one).
+func checkClientAuthKey(key crypto.PrivateKey, keyType string) error {
+	if isV2Key(key, keyType) {
+		return fmt.Errorf("Client authorization keys require %s onion key", KeyTypeED25519V3)
+	}
+	return nil
+}
+
+// v2ClientNames returns names of n v2 clients.
+func v2ClientNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("client%d", i+1)
+	}
+	return names
+}
+
+// hidServAuth returns HidServAuth torrc lines with auth cookies
+// tor has generated for v2 clients of onion oi.
+func hidServAuth(oi *bulb.OnionInfo) []string {
+	if oi.RawResponse == nil {
+		return nil
+	}
+	var lines []string
+	for _, l := range oi.RawResponse.Data {
+		auth, ok := strings.CutPrefix(l, "ClientAuth=")
+		if !ok {
+			continue
+		}
+		name, cookie, ok := strings.Cut(auth, ":")
+		if !ok {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("HidServAuth %s.onion %s %s", oi.OnionID, cookie, name))
+	}
+	return lines
+}
@@ -0,0 +1,209 @@
+// config.go - defaults for flags from environment and config file.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "ONIONIZE_"
+
+// defaultConfigPath returns path of config file used unless told
+// otherwise, e.g. ~/.config/onionize/config.toml.
+func defaultConfigPath() string {
+	if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "onionize", "config.toml")
+}
+
+// envName returns name of environment variable for flag name,
+// e.g. ONIONIZE_CONTROL_ADDR for control-addr.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyConfig sets flags which are not given on command line from
+// ONIONIZE_* environment variables or, failing that, from options
+// of config file at path named after the flags. Missing config
+// file is fine unless required is set.
+func applyConfig(path string, required bool) error {
+	cfg := map[string][]string{}
+	if path != "" {
+		var err error
+		cfg, err = readConfig(path)
+		if os.IsNotExist(err) && !required {
+			cfg, err = map[string][]string{}, nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read config: %v", err)
+		}
+	}
+	for name := range cfg {
+		if f := flag.Lookup(name); f == nil || name == "config" {
+			return fmt.Errorf("Unknown option %q in %s", name, path)
+		}
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+		values, ok := cfg[f.Name]
+		if v, isEnv := os.LookupEnv(envName(f.Name)); isEnv {
+			values, ok = []string{v}, true
+		}
+		if !ok {
+			return
+		}
+		for _, v := range values {
+			if serr := flag.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("Invalid value %q for %s: %v", v, f.Name, serr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// readConfig reads key = value options of TOML file at path.
+// Values are strings, booleans, numbers or arrays of them (for
+// repeatable flags), all kept as text to set flags with. Tables
+// are not supported.
+func readConfig(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := make(map[string][]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: tables are not supported", path, n)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key = strings.TrimSpace(key)
+		values, err := parseConfigValues(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		cfg[key] = values
+	}
+	return cfg, sc.Err()
+}
+
+// stripComment cuts # comment off line unless it's inside of a
+// string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValues parses a value or an array of values of s.
+func parseConfigValues(s string) ([]string, error) {
+	inner, ok := strings.CutPrefix(s, "[")
+	if !ok {
+		v, rest, err := parseConfigValue(s)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected %q after value", rest)
+		}
+		return []string{v}, nil
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return nil, errors.New("unterminated array")
+	}
+	var values []string
+	for inner = strings.TrimSpace(inner); inner != ""; {
+		v, rest, err := parseConfigValue(inner)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		rest = strings.TrimSpace(rest)
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("unexpected %q in array", rest)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+		inner = rest
+	}
+	return values, nil
+}
+
+// parseConfigValue parses a value at the beginning of s and returns
+// the rest of s.
+func parseConfigValue(s string) (v, rest string, err error) {
+	if s == "" {
+		return "", "", errors.New("missing value")
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case '\'':
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : i+1], s[i+2:], nil
+	default:
+		i := strings.IndexAny(s, ", \t]")
+		if i < 0 {
+			i = len(s)
+		}
+		return s[:i], s[i:], nil
+	}
+}
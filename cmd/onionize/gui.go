@@ -9,16 +9,18 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 	"github.com/nogoegst/onionize"
-	"rsc.io/qr"
 )
 
 const applicationTitle = "onionize"
@@ -29,11 +31,100 @@ const (
 	FileText           = "a file"
 	DirectoryText      = "a directory"
 	ZipText            = "contents of zip"
+	DropText           = "or drop files here"
 	ActionButtonText   = "Start sharing"
 	ProgressButtonText = "Starting sharing..."
+	StopButtonText     = "Stop sharing"
+	WaitingText        = "No downloads yet"
 )
 
-func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errChan <-chan error) {
+// idleAdd runs f in the GTK main loop.
+func idleAdd(f func()) {
+	if _, err := glib.IdleAdd(f); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func showError(err error) {
+	errDialog := gtk.MessageDialogNew(win, gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE, err.Error())
+	errDialog.Run()
+	errDialog.Destroy()
+}
+
+// droppedPaths returns local paths from text/uri-list data.
+func droppedPaths(data []byte) ([]string, error) {
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme != "file" {
+			return nil, fmt.Errorf("Unable to share %s: not a local file", line)
+		}
+		paths = append(paths, u.Path)
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("Nothing to share")
+	}
+	return paths, nil
+}
+
+func qrImage(link onionize.ResultLink) (*gtk.Image, error) {
+	qrcode, err := link.QR()
+	if err != nil {
+		return nil, err
+	}
+	pbl, err := gdk.PixbufLoaderNewWithType("png")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a pixbuf: %v", err)
+	}
+	_, err = pbl.Write(qrcode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write to pixbuf: %v", err)
+	}
+	qrPixbuf, err := pbl.GetPixbuf()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get pixbuf: %v", err)
+	}
+	qrCodeWidget, err := gtk.ImageNewFromPixbuf(qrPixbuf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create qrcode widget: %v", err)
+	}
+	return qrCodeWidget, nil
+}
+
+// showProgress shows progress of downloads from events on bar
+// until the share of s is over.
+func showProgress(s *onionize.Service, events <-chan onionize.Event, bar *gtk.ProgressBar) {
+	for {
+		select {
+		case e := <-events:
+			switch e := e.(type) {
+			case onionize.DownloadProgress:
+				idleAdd(func() {
+					if e.Total > 0 {
+						bar.SetText(fmt.Sprintf("%s: %d/%d bytes", e.URL, e.Bytes, e.Total))
+						bar.SetFraction(float64(e.Bytes) / float64(e.Total))
+					} else {
+						bar.SetText(fmt.Sprintf("%s: %d bytes", e.URL, e.Bytes))
+						bar.Pulse()
+					}
+				})
+			case onionize.DownloadCompleted:
+				idleAdd(func() {
+					bar.SetText(fmt.Sprintf("%s: done (%d downloads)", e.URL, s.Stats().Downloads))
+					bar.SetFraction(1)
+				})
+			}
+		case <-s.Done():
+			return
+		}
+	}
+}
+
+func guiMain(ctx context.Context) {
 	gtk.Init(nil)
 
 	var err error
@@ -50,6 +141,11 @@ func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errCh
 	win.SetDefaultSize(1, 1)
 	win.SetResizable(false)
 
+	box, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 12)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+
 	grid, err := gtk.GridNew()
 	if err != nil {
 		log.Fatal("Unable to create grid:", err)
@@ -57,6 +153,7 @@ func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errCh
 	grid.SetOrientation(gtk.ORIENTATION_VERTICAL)
 	grid.SetRowSpacing(12)
 	grid.SetColumnSpacing(12)
+	box.PackStart(grid, false, false, 0)
 
 	// share type picker
 	shareTypePickerLabel, err := gtk.LabelNew("I want to share")
@@ -125,6 +222,12 @@ func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errCh
 	})
 	updateFileChooser(FileText)
 
+	dropLabel, err := gtk.LabelNew(DropText)
+	if err != nil {
+		log.Fatal(err)
+	}
+	grid.Attach(dropLabel, 0, 2, 2, 1)
+
 	// slug row
 	/*
 		slugChkBoxLabel, err := gtk.LabelNew("secret prefix")
@@ -158,6 +261,38 @@ func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errCh
 	if err != nil {
 		log.Fatal("Unable to create button:", err)
 	}
+	grid.Attach(doBtn, 0, 5, 2, 1)
+
+	// share view: link, its QR code, progress and stop button
+	shareGrid, err := gtk.GridNew()
+	if err != nil {
+		log.Fatal("Unable to create grid:", err)
+	}
+	shareGrid.SetOrientation(gtk.ORIENTATION_VERTICAL)
+	shareGrid.SetRowSpacing(12)
+	shareGrid.SetNoShowAll(true)
+	box.PackStart(shareGrid, false, false, 0)
+
+	urlEntry, err := gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	urlEntry.SetHExpand(true)
+	urlEntry.SetEditable(false)
+	shareGrid.Attach(urlEntry, 0, 0, 1, 1)
+
+	progressBar, err := gtk.ProgressBarNew()
+	if err != nil {
+		log.Fatal("Unable to create progress bar:", err)
+	}
+	progressBar.SetShowText(true)
+	shareGrid.Attach(progressBar, 0, 2, 1, 1)
+
+	stopBtn, err := gtk.ButtonNewWithLabel(StopButtonText)
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	shareGrid.Attach(stopBtn, 0, 3, 1, 1)
 
 	fadeOut := func() {
 		fchooserBtn.SetSensitive(false)
@@ -179,6 +314,82 @@ func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errCh
 		grid.ShowAll()
 	}
 
+	// service is the running share, touched in the main loop only
+	var service *onionize.Service
+	var qrCodeWidget *gtk.Image
+
+	showShare := func(s *onionize.Service) {
+		service = s
+		link := onionize.ResultLink{URL: s.Link}
+		linkString := link.URL.String()
+		urlEntry.SetText(linkString)
+		urlEntry.SelectRegion(0, len(linkString))
+		var err error
+		qrCodeWidget, err = qrImage(link)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shareGrid.Attach(qrCodeWidget, 0, 1, 1, 1)
+		progressBar.SetFraction(0)
+		progressBar.SetText(WaitingText)
+		stopBtn.SetSensitive(true)
+		grid.Hide()
+		shareGrid.ShowAll()
+		win.Resize(1, 1)
+	}
+
+	hideShare := func() {
+		service = nil
+		if qrCodeWidget != nil {
+			qrCodeWidget.Destroy()
+			qrCodeWidget = nil
+		}
+		shareGrid.Hide()
+		fadeIn()
+		win.Resize(1, 1)
+	}
+
+	share := func(paths []string, zip bool) {
+		fadeOut()
+		events := make(chan onionize.Event, 64)
+		p := onionize.Parameters{
+			Debug:           debug,
+			ControlPath:     "default://",
+			ControlPassword: "",
+			Zip:             zip,
+			Slug:            true, //slugChkBox.GetActive(),
+			Passphrase:      "",   //passphrase,
+			Events:          events,
+		}
+		// Names may contain delimiters of pathspec
+		if zip {
+			p.Pathspec = paths[0]
+		} else {
+			p.Paths = paths
+		}
+		// Start tor if there is no system one
+		p.StartTorIfNeeded = true
+		go func() {
+			s, err := onionize.New(ctx, p)
+			if err != nil {
+				idleAdd(func() {
+					showError(err)
+					fadeIn()
+				})
+				return
+			}
+			idleAdd(func() { showShare(s) })
+			s.Start()
+			showProgress(s, events, progressBar)
+			idleAdd(func() {
+				hideShare()
+				if err := s.Err(); err != nil {
+					showError(err)
+				}
+			})
+		}()
+	}
+
 	doBtn.Connect("clicked", func() {
 		path := fchooserBtn.GetFilename()
 		if path == "" {
@@ -190,81 +401,47 @@ func guiMain(paramsCh chan<- onionize.Parameters, linkChan <-chan url.URL, errCh
 				log.Fatalf("Unable to get passphrase: %v", err)
 			}
 		*/
-		fadeOut()
-		zip := combo.GetActiveText() == ZipText
-		p := onionize.Parameters{
-			Debug:           debug,
-			ControlPath:     "default://",
-			ControlPassword: "",
-			Pathspec:        path,
-			Zip:             zip,
-			Slug:            true, //slugChkBox.GetActive(),
-			Passphrase:      "",   //passphrase,
-		}
-		paramsCh <- p
+		share([]string{path}, combo.GetActiveText() == ZipText)
+	})
 
+	stopBtn.Connect("clicked", func() {
+		if service == nil {
+			return
+		}
+		stopBtn.SetSensitive(false)
+		service.Close()
 	})
-	grid.Attach(doBtn, 0, 5, 2, 1)
 
-	urlEntry, err := gtk.EntryNew()
+	// Share whatever is dropped onto the window
+	target, err := gtk.TargetEntryNew("text/uri-list", gtk.TARGET_OTHER_APP, 0)
 	if err != nil {
-		log.Fatal("Unable to create entry:", err)
+		log.Fatal(err)
 	}
-	urlEntry.SetHExpand(true)
-	go func() {
-		for {
-			select {
-			case link := <-linkChan:
-				_, err = glib.IdleAdd(func() {
-					linkString := link.String()
-					urlEntry.SetText(linkString)
-					doBtn.Destroy()
-					grid.Attach(urlEntry, 0, 2, 2, 1)
-					urlEntry.SelectRegion(0, len(linkString))
-
-					qrcode, err := qr.Encode(linkString, qr.L)
-					if err != nil {
-						log.Fatal(err)
-					}
-					pbl, err := gdk.PixbufLoaderNewWithType("png")
-					if err != nil {
-						log.Fatalf("Failed to create a pixbuf: %v", err)
-					}
-					_, err = pbl.Write(qrcode.PNG())
-					if err != nil {
-						log.Fatalf("Failed to write to pixbuf: %v", err)
-					}
-					qrPixbuf, err := pbl.GetPixbuf()
-					if err != nil {
-						log.Fatalf("Failed to get pixbuf: %v", err)
-					}
-					qrCodeWidget, err := gtk.ImageNewFromPixbuf(qrPixbuf)
-					if err != nil {
-						log.Fatalf("Failed to create qrcode widget: %v", err)
-					}
-					grid.Attach(qrCodeWidget, 0, 3, 2, 1)
-					grid.ShowAll()
-				})
-				if err != nil {
-					log.Fatal(err)
-				}
-			case err := <-errChan:
-				errDialog := gtk.MessageDialogNew(win, gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE, err.Error())
-				_, err = glib.IdleAdd(func() {
-					errDialog.Run()
-					errDialog.Destroy()
-					fadeIn()
-				})
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
+	win.DragDestSet(gtk.DEST_DEFAULT_ALL, []gtk.TargetEntry{*target}, gdk.ACTION_COPY)
+	win.Connect("drag-data-received", func(_ *gtk.Window, _ *gdk.DragContext, x, y int, data uintptr) {
+		if service != nil || !doBtn.GetSensitive() {
+			return
 		}
-	}()
+		paths, err := droppedPaths(gtk.GetData(data))
+		if err != nil {
+			showError(err)
+			return
+		}
+		share(paths, false)
+	})
 
-	win.Add(&grid.Container.Widget)
+	win.Add(box)
 	win.ShowAll()
+	go func() {
+		<-ctx.Done()
+		idleAdd(gtk.MainQuit)
+	}()
 
 	gtk.Main()
+	// Take the onion down before leaving
+	if service != nil {
+		service.Close()
+		<-service.Done()
+	}
 	os.Exit(0)
 }
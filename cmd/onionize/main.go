@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
-	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 
-	"github.com/nogoegst/fileserver"
 	"github.com/nogoegst/onionize"
 	"github.com/nogoegst/onionutil"
 	"github.com/nogoegst/terminal"
@@ -31,21 +36,79 @@ func main() {
 	var noSlugFlag = flag.Bool("no-slug", defaultNoSlugFlag,
 		"Do not use slugs")
 	var zipFlag = flag.Bool("zip", false,
-		"Serve zip file contents")
+		"Serve contents of zip, tar, tar.gz or tar.xz archive")
+	var slugLengthFlag = flag.Int("slug-length", 0,
+		"Length of random slugs")
+	var slugFlag = flag.String("slug", "",
+		"Use this slug instead of random one")
+	var zipDirFlag = flag.Bool("zip-dir", false,
+		"Serve directories as a zip archive")
+	var zipDownloadsFlag = flag.Bool("zip-downloads", false,
+		"Let directories be downloaded as zip with ?download=zip")
+	var separateFlag = flag.Bool("separate", false,
+		"Share every path via an onion of its own")
+	var progressFlag = flag.Bool("progress", false,
+		"Show progress of downloads on stderr")
+	var checksumFlag = flag.Bool("checksum", false,
+		"Send SHA-256 digests of files to clients and print them")
+	var stdinFlag = flag.Bool("stdin", false,
+		"Share data read from stdin as a single file")
+	var nameFlag = flag.String("name", "stdin",
+		"Name of the file shared with -stdin (or title of -text)")
+	var textFlag = flag.Bool("text", false,
+		"Share arguments (or stdin if there are none) as text")
+	var markdownFlag = flag.Bool("markdown", false,
+		"Render text shared with -text as markdown")
+	var recipientsFlag = flag.String("recipients", "",
+		"Make links for these comma-separated recipients (add/revoke/list them on stdin)")
+	var authFlag = flag.String("auth", "",
+		"Require HTTP Basic auth as user:password (asks for password if only user is given)")
+	var maxRateFlag = flag.Int64("max-rate", 0,
+		"Limit total upload rate to this many bytes per second")
+	var maxConnsFlag = flag.Int("max-conns", 0,
+		"Limit the number of simultaneous connections")
+	var logFileFlag = flag.String("log-file", "",
+		"Append access log in JSON to this file")
+	var templateFlag = flag.String("template", "",
+		"Path to HTML template defining \"listing\" and/or \"landing\" pages")
+	var landingFlag = flag.Bool("landing", false,
+		"Show a page with a download button for a single file")
+	var forwards []onionize.PortForward
+	flag.Func("forward", "Forward onion port to local port, host:port or unix:path instead of sharing (e.g. 22:127.0.0.1:22, repeatable)",
+		func(s string) error {
+			f, err := onionize.ParsePortForward(s)
+			if err != nil {
+				return err
+			}
+			forwards = append(forwards, f)
+			return nil
+		})
 	var qrFlag = flag.Bool("qr", false,
 		"Print link in QR code to stdout")
+	var qrPNGPath = flag.String("qr-png", "",
+		"Write QR code of the link to this PNG file")
 	var localFlag = flag.Bool("local", defaultLocalFlag,
 		"Run in outside-reachable mode without onion service")
 	var noTLSFlag = flag.Bool("no-tls", false,
 		"Disable TLS")
+	var tlsFlag = flag.Bool("tls", false,
+		"Serve HTTPS with self-signed certificate unless -tls-cert and -tls-key are given")
 	var passphraseFlag = flag.Bool("p", false,
 		"Ask for passphrase to generate onion key")
+	var passphraseFile = flag.String("passphrase-file", "",
+		"Read passphrase to generate onion key from this file")
+	var passphraseSlugFlag = flag.Bool("passphrase-slug", false,
+		"Derive the slug from the passphrase too to keep the whole link across restarts")
 	var control = flag.String("control-addr", "default://",
 		"Set Tor control address to be used")
 	var controlPasswd = flag.String("control-passwd", "",
 		"Set Tor control auth password")
+	var keyTypeFlag = flag.String("key-type", onionize.KeyTypeED25519V3,
+		"Type of onion key: ed25519-v3 or rsa1024 (deprecated v2)")
 	var idKeyPath = flag.String("id-key", "",
 		"Path to onion identity private key")
+	var identityPath = flag.String("identity", "",
+		"Path to onion key to load or, on first run, to create")
 	var tlsCertPath = flag.String("tls-cert", "",
 		"Path to TLS certificate")
 	var tlsKeyPath = flag.String("tls-key", "",
@@ -54,33 +117,226 @@ func main() {
 		"tlspin private key (\"whateverkey\" to generate one)")
 	var startTor = flag.Bool("start-tor", false,
 		"start tor ourselves")
+	var torPath = flag.String("tor-path", "",
+		"Path to tor binary to start")
+	var onExisting = flag.String("on-existing", onionize.OnExistingFail,
+		"What to do if onion is already running: fail, reuse or recreate")
+	var cacheListingsFlag = flag.Bool("cache-listings", false,
+		"Render directory listings once (for static content)")
+	var connIdleDeadline = flag.Duration("conn-idle-deadline", 0,
+		"Drop connections which don't send request headers for this long")
+	var descriptorFlag = flag.Bool("descriptor", false,
+		"Serve share metadata at /.onionize/descriptor.json")
+	var slugDefenseFlag = flag.Bool("slug-defense", false,
+		"Delay responses to frequent requests with wrong slug")
+	var slugDefensePerClientFlag = flag.Bool("slug-defense-per-client", false,
+		"Like -slug-defense, but count wrong slugs per client address (for -local)")
+	var onMissFlag = flag.String("on-miss", onionize.MissNotFound,
+		"How to answer requests with wrong slug: not-found, reset or decoy")
+	var decoyPath = flag.String("decoy", "",
+		"Path to HTML page to answer wrong slugs with (implies -on-miss decoy)")
+	var warnSensitiveFlag = flag.Bool("warn-sensitive", false,
+		"Warn about sharing private keys, credentials and such")
+	var refuseSensitiveFlag = flag.Bool("refuse-sensitive", false,
+		"Refuse to share private keys, credentials and such")
+	var clientAuthFlag = flag.Int("client-auth", 0,
+		"Authorize this many new clients and print their credentials")
+	var exportKeyPath = flag.String("export-key", "",
+		"Write onion private key to this path in tor's format")
+	var ttlFlag = flag.Duration("ttl", 0,
+		"Stop sharing after this time")
+	var showExpiryFlag = flag.Bool("show-expiry", false,
+		"Tell clients when the share expires")
+	var checksumsFlag = flag.Bool("checksums", false,
+		"Include SHA-256 checksums of files in share descriptor")
+	var headFirstFlag = flag.Bool("head-first", false,
+		"Require HEAD request before downloading a file")
+	var maskModTimesFlag = flag.Bool("mask-modtimes", false,
+		"Hide modification times of shared files")
+	var virtPortFlag = flag.String("port", "",
+		"Comma-separated ports of the onion service (80 or 443 with TLS by default)")
+	var receiveFlag = flag.String("receive", "",
+		"Receive uploaded files into this directory instead of sharing")
+	var reconnectFlag = flag.Bool("reconnect", false,
+		"Keep sharing if connection to tor is lost: connect again and publish the same onion")
+	var metricsAddrFlag = flag.String("metrics-addr", "",
+		"Serve Prometheus metrics at /metrics on this local address (e.g. 127.0.0.1:9100)")
+	var webdavFlag = flag.Bool("webdav", false,
+		"Serve the directory over WebDAV to be mounted as a network drive")
+	var webdavReadOnlyFlag = flag.Bool("webdav-read-only", false,
+		"Serve the directory over WebDAV without letting clients change it (implies -webdav)")
+	var maxUploadSizeFlag = flag.Int64("max-upload-size", 1<<30,
+		"Maximum size of an upload in bytes (0 for no limit)")
+	var stopAfterFlag = flag.Int("stop-after", 0,
+		"Stop sharing after this many downloads")
+	var forceDownloadFlag = flag.Bool("force-download", false,
+		"Make browsers save a shared file instead of displaying it")
+	var contentTypeFlag = flag.String("content-type", "",
+		"Serve a shared file as this MIME type (e.g. \"text/plain; charset=utf-8\")")
+	var noIndexFlag = flag.Bool("no-index", false,
+		"Do not list contents of directories")
+	var requireHeaderFlag = flag.String("require-header", "",
+		"Serve only requests with this header (\"Name: value\")")
+	var configPath = flag.String("config", defaultConfigPath(),
+		"Read defaults for flags from this file (ONIONIZE_* environment variables override it)")
 	flag.Parse()
+	if err := applyConfig(*configPath, isFlagSet("config")); err != nil {
+		log.Fatal(err)
+	}
 
 	debug = *debugFlag
 	paramsCh := make(chan onionize.Parameters)
-	linkChan := make(chan url.URL)
+	linkChan := make(chan onionize.ResultLink)
 	errChan := make(chan error)
 
+	// Stop sharing gracefully on the first interrupt and
+	// at once on the second one
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	go func() {
-		p := <-paramsCh
-		go func() {
-			errChan <- onionize.Onionize(p, linkChan)
-		}()
+		<-ctx.Done()
+		stop()
 	}()
 
-	if len(flag.Args()) == 0 {
-		guiMain(paramsCh, linkChan, errChan)
+	if len(flag.Args()) == 0 && *receiveFlag == "" && !*stdinFlag && !*textFlag && len(forwards) == 0 {
+		guiMain(ctx)
 	} else {
+		go func() {
+			p := <-paramsCh
+			if len(p.Recipients) != 0 {
+				errChan <- shareToRecipients(ctx, p, linkChan)
+				return
+			}
+			errChan <- onionize.Onionize(ctx, p, linkChan)
+		}()
 		p := onionize.Parameters{
-			Debug:           debug,
-			ControlPath:     *control,
-			ControlPassword: *controlPasswd,
-			Pathspec:        fileserver.JoinPathspec(flag.Args()),
-			Slug:            true,
-			Zip:             *zipFlag,
-			NoOnion:         *localFlag,
-			StartTor:        *startTor,
+			Debug:            debug,
+			ControlPath:      *control,
+			ControlPassword:  *controlPasswd,
+			Pathspec:         onionize.JoinPathspec(flag.Args()),
+			Slug:             true,
+			Zip:              *zipFlag,
+			ZipDir:           *zipDirFlag,
+			NoOnion:          *localFlag,
+			StartTor:         *startTor,
+			TorPath:          *torPath,
+			OnExisting:       *onExisting,
+			CacheListings:    *cacheListingsFlag,
+			ConnIdleDeadline: *connIdleDeadline,
+			Descriptor:       *descriptorFlag,
+		}
+		// Start tor if there is no system one unless told where it is
+		p.StartTorIfNeeded = !isFlagSet("control-addr")
+		p.DescriptorChecksums = *checksumsFlag
+		p.RequireHeadFirst = *headFirstFlag
+		p.MaskModTimes = *maskModTimesFlag
+		p.NoIndex = *noIndexFlag
+		p.ZipDownloads = *zipDownloadsFlag
+		p.SeparateOnions = *separateFlag
+		p.MaxRate = *maxRateFlag
+		p.LandingPage = *landingFlag
+		if *templateFlag != "" {
+			t, err := template.ParseFiles(*templateFlag)
+			if err != nil {
+				log.Fatalf("Unable to load template: %v", err)
+			}
+			p.Templates = t
+		}
+		if *logFileFlag != "" {
+			f, err := os.OpenFile(*logFileFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				log.Fatalf("Unable to open access log: %v", err)
+			}
+			defer f.Close()
+			p.AccessLog = f
+		}
+		p.MaxConns = *maxConnsFlag
+		p.Forwards = forwards
+		if *stdinFlag {
+			if *passphraseFlag || (*authFlag != "" && !strings.Contains(*authFlag, ":")) {
+				log.Fatal("Unable to read password and content both from stdin")
+			}
+			p.Content = os.Stdin
+			p.ContentName = *nameFlag
+		}
+		if *textFlag {
+			text := strings.Join(flag.Args(), " ")
+			if len(flag.Args()) == 0 {
+				if *passphraseFlag || (*authFlag != "" && !strings.Contains(*authFlag, ":")) {
+					log.Fatal("Unable to read password and text both from stdin")
+				}
+				b, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					log.Fatalf("Unable to read text: %v", err)
+				}
+				text = string(b)
+			}
+			if strings.TrimSpace(text) == "" {
+				log.Fatal("No text to share")
+			}
+			p.Text = text
+			p.Pathspec = ""
+			if isFlagSet("name") {
+				p.ContentName = *nameFlag
+			}
+			if *markdownFlag {
+				p.TextFormat = onionize.TextFormatMarkdown
+			}
 		}
+		if *recipientsFlag != "" {
+			if *stdinFlag || (*textFlag && len(flag.Args()) == 0) {
+				log.Fatal("Unable to read content and commands both from stdin")
+			}
+			if len(forwards) != 0 || *separateFlag {
+				log.Fatal("Recipients can't be combined with forwards or separate onions")
+			}
+			p.Recipients = strings.Split(*recipientsFlag, ",")
+		}
+		p.Digests = *checksumFlag
+		if *progressFlag || *checksumFlag {
+			events := make(chan onionize.Event, 64)
+			p.Events = events
+			go showEvents(events, *progressFlag)
+		}
+		p.ForceDownload = *forceDownloadFlag
+		p.ContentType = *contentTypeFlag
+		p.StopAfter = *stopAfterFlag
+		p.ReceiveDir = *receiveFlag
+		p.MaxUploadSize = *maxUploadSizeFlag
+		p.ReconnectTor = *reconnectFlag
+		p.MetricsAddr = *metricsAddrFlag
+		p.WebDAV = *webdavFlag || *webdavReadOnlyFlag
+		p.WebDAVReadOnly = *webdavReadOnlyFlag
+		p.KeyType = *keyTypeFlag
+		p.ClientAuthNew = *clientAuthFlag
+		p.IdentityPath = *identityPath
+		if *virtPortFlag != "" {
+			for i, s := range strings.Split(*virtPortFlag, ",") {
+				port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+				if err != nil || port == 0 {
+					log.Fatalf("Invalid onion port: %q", s)
+				}
+				if i == 0 {
+					p.VirtualPort = uint16(port)
+				} else {
+					p.VirtualPorts = append(p.VirtualPorts, uint16(port))
+				}
+			}
+		}
+		if *requireHeaderFlag != "" {
+			hdr := strings.SplitN(*requireHeaderFlag, ":", 2)
+			if len(hdr) != 2 {
+				log.Fatalf("Invalid required header: %q", *requireHeaderFlag)
+			}
+			p.RequireHeader = &onionize.RequireHeader{
+				Name:  strings.TrimSpace(hdr[0]),
+				Value: strings.TrimSpace(hdr[1]),
+			}
+		}
+		p.ExportKeyPath = *exportKeyPath
+		p.TTL = *ttlFlag
+		p.ShowExpiry = *showExpiryFlag
+		p.WarnSensitiveFiles = *warnSensitiveFlag
+		p.RefuseSensitiveFiles = *refuseSensitiveFlag
 		if !(*noTLSFlag) { // TLS enabled
 			// default to tlspin tofu by default for local mode
 			if *tlspinKey == "" && *localFlag {
@@ -108,6 +364,12 @@ func main() {
 				if err != nil {
 					log.Fatalf("unable to load tlspin private key: %v", err)
 				}
+			} else if *tlsFlag {
+				var err error
+				p.TLSConfig, err = onionize.SelfSignedTLSConfig()
+				if err != nil {
+					log.Fatal(err)
+				}
 			}
 		}
 		if *passphraseFlag {
@@ -118,6 +380,12 @@ func main() {
 			}
 			fmt.Printf("\n")
 			p.Passphrase = string(onionPassphrase)
+		} else if *passphraseFile != "" {
+			b, err := os.ReadFile(*passphraseFile)
+			if err != nil {
+				log.Fatalf("Unable to read onion passphrase: %v", err)
+			}
+			p.Passphrase = strings.TrimRight(string(b), "\r\n")
 		} else if *idKeyPath != "" {
 			var err error
 			p.IdentityKey, _, err = onionutil.LoadPrivateKeyFile(*idKeyPath)
@@ -129,26 +397,163 @@ func main() {
 		if *noSlugFlag {
 			p.Slug = false
 		} else {
-			// Disable slugs when using TLS
-			if p.TLSConfig != nil {
+			// Disable slugs when using TLS locally (tlspin by
+			// default). TLS over onion keeps the slug.
+			if p.TLSConfig != nil && (*localFlag || *tlspinKey != "") {
 				p.Slug = false
 			}
 		}
+		if *authFlag != "" {
+			user, password, ok := strings.Cut(*authFlag, ":")
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Enter password for %s: ", user)
+				b, err := terminal.ReadPassword(0)
+				if err != nil {
+					log.Fatalf("Unable to read password: %v", err)
+				}
+				fmt.Fprintf(os.Stderr, "\n")
+				password = string(b)
+			}
+			p.BasicAuthUser = user
+			p.BasicAuthPassword = password
+		}
+		p.SlugBruteforceDefense = *slugDefenseFlag
+		p.SlugBruteforceDefensePerClient = *slugDefensePerClientFlag
+		p.MissPolicy = *onMissFlag
+		if *decoyPath != "" {
+			b, err := os.ReadFile(*decoyPath)
+			if err != nil {
+				log.Fatalf("Unable to read decoy page: %v", err)
+			}
+			p.DecoyPage = string(b)
+			p.MissPolicy = onionize.MissDecoy
+		}
+		p.SlugLength = *slugLengthFlag
+		p.SlugValue = *slugFlag
+		p.PassphraseSlug = *passphraseSlugFlag
 
 		paramsCh <- p
 
 		for {
 			select {
 			case link := <-linkChan:
-				linkString := link.String()
+				linkString := link.URL.String()
+				if len(forwards) != 0 {
+					linkString = link.URL.Host
+				}
 				if *qrFlag {
 					textqr.Write(os.Stdout, linkString, textqr.L, true, false)
 				}
+				if *qrPNGPath != "" {
+					b, err := link.QR()
+					if err != nil {
+						log.Fatalf("Unable to make QR code: %v", err)
+					}
+					if err := os.WriteFile(*qrPNGPath, b, 0644); err != nil {
+						log.Fatalf("Unable to write QR code: %v", err)
+					}
+				}
+				if link.Path != "" {
+					fmt.Printf("%s: ", link.Path)
+				}
 				fmt.Println(linkString)
+				for _, auth := range link.ClientAuth {
+					fmt.Println(auth)
+				}
+				for _, r := range link.Recipients {
+					fmt.Printf("%s: %s\n", r.Name, r.URL.String())
+				}
 
 			case err := <-errChan:
-				log.Fatal(err)
+				if err != nil && err != context.Canceled {
+					log.Fatal(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// shareToRecipients shares p like onionize.Onionize does and
+// manages recipients by commands read from stdin:
+// "add NAME", "revoke NAME" and "list".
+func shareToRecipients(ctx context.Context, p onionize.Parameters, linkChan chan<- onionize.ResultLink) error {
+	s, err := onionize.New(ctx, p)
+	if err != nil {
+		return err
+	}
+	select {
+	case linkChan <- onionize.ResultLink{URL: s.Link, Key: s.Key, ClientAuth: s.ClientAuth, Recipients: s.Recipients()}:
+	case <-ctx.Done():
+		<-s.Done()
+		return ctx.Err()
+	}
+	s.Start()
+	go func() {
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			cmd, name, _ := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+			name = strings.TrimSpace(name)
+			switch cmd {
+			case "add":
+				link, err := s.AddRecipient(name)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				fmt.Printf("%s: %s\n", name, link.String())
+			case "revoke":
+				if err := s.RevokeRecipient(name); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "Revoked %s\n", name)
+			case "list":
+				for _, r := range s.Recipients() {
+					fmt.Printf("%s: %s\n", r.Name, r.URL.String())
+				}
+			case "":
+			default:
+				fmt.Fprintf(os.Stderr, "Unknown command %q (use add, revoke or list)\n", cmd)
 			}
 		}
+	}()
+	<-s.Done()
+	return s.Err()
+}
+
+// showEvents prints digests of files from events in sha256sum
+// format and, if progress is set, renders download progress on
+// stderr.
+func showEvents(events <-chan onionize.Event, progress bool) {
+	for e := range events {
+		switch e := e.(type) {
+		case onionize.DigestComputed:
+			fmt.Printf("%s  %s\n", e.SHA256, strings.TrimPrefix(e.Path, "/"))
+		}
+		if !progress {
+			continue
+		}
+		switch e := e.(type) {
+		case onionize.DownloadProgress:
+			if e.Total > 0 {
+				fmt.Fprintf(os.Stderr, "\r%s: %d/%d bytes (%d%%)", e.URL, e.Bytes, e.Total, e.Bytes*100/e.Total)
+			} else {
+				fmt.Fprintf(os.Stderr, "\r%s: %d bytes", e.URL, e.Bytes)
+			}
+		case onionize.DownloadCompleted:
+			fmt.Fprintf(os.Stderr, "\r%s: %d bytes, done\n", e.URL, e.Bytes)
+		}
 	}
 }
+
+// isFlagSet reports whether flag name was passed on command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
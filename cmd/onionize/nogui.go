@@ -9,12 +9,10 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net/url"
-
-	"github.com/nogoegst/onionize"
 )
 
-func guiMain(chan onionize.Parameters, chan url.URL, chan error) {
+func guiMain(context.Context) {
 	log.Fatal("Please specify path to target")
 }
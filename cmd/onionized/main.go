@@ -0,0 +1,323 @@
+// Command onionized keeps shares up and lets them be managed via
+// HTTP API on a unix socket:
+//
+//	POST /shares         create a share (JSON shareRequest)
+//	GET /shares          list shares
+//	DELETE /shares/{id}  stop a share
+//
+// All shares publish their onions via the same tor.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nogoegst/onionize"
+)
+
+// shareRequest describes a share to create.
+type shareRequest struct {
+	// Paths are absolute paths to share
+	Paths        []string `json:"paths"`
+	NoSlug       bool     `json:"no_slug"`
+	ZipDir       bool     `json:"zip_dir"`
+	ZipDownloads bool     `json:"zip_downloads"`
+	// TTL is a duration (e.g. "1h")
+	TTL        string `json:"ttl"`
+	StopAfter  int    `json:"stop_after"`
+	ClientAuth int    `json:"client_auth"`
+}
+
+// shareInfo describes a running share.
+type shareInfo struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Paths      []string  `json:"paths"`
+	ClientAuth []string  `json:"client_auth,omitempty"`
+	Created    time.Time `json:"created"`
+	Downloads  int64     `json:"downloads"`
+	BytesSent  int64     `json:"bytes_sent"`
+}
+
+type share struct {
+	info    shareInfo
+	service *onionize.Service
+}
+
+type daemon struct {
+	base onionize.Parameters
+	mu   sync.Mutex
+	// shares by ID
+	shares map[string]*share
+}
+
+func (d *daemon) info(sh *share) shareInfo {
+	info := sh.info
+	stats := sh.service.Stats()
+	info.Downloads = stats.Downloads
+	info.BytesSent = stats.BytesSent
+	return info
+}
+
+func (d *daemon) create(ctx context.Context, req shareRequest) (*share, error) {
+	if len(req.Paths) == 0 {
+		return nil, errors.New("No paths to share")
+	}
+	for _, path := range req.Paths {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("Path %q is not absolute", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	p := d.base
+	p.Paths = req.Paths
+	p.Slug = !req.NoSlug
+	p.ZipDir = req.ZipDir
+	p.ZipDownloads = req.ZipDownloads
+	p.StopAfter = req.StopAfter
+	p.ClientAuthNew = req.ClientAuth
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TTL: %v", err)
+		}
+		p.TTL = ttl
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	s, err := onionize.New(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+	sh := &share{
+		info: shareInfo{
+			ID:         hex.EncodeToString(id),
+			URL:        s.Link.String(),
+			Paths:      req.Paths,
+			ClientAuth: s.ClientAuth,
+			Created:    time.Now(),
+		},
+		service: s,
+	}
+	d.mu.Lock()
+	d.shares[sh.info.ID] = sh
+	d.mu.Unlock()
+	// Forget shares which are over by themselves (TTL and such)
+	go func() {
+		<-s.Done()
+		if err := s.Err(); err != nil {
+			log.Printf("Share %s has stopped: %v", sh.info.ID, err)
+		}
+		d.mu.Lock()
+		delete(d.shares, sh.info.ID)
+		d.mu.Unlock()
+	}()
+	return sh, nil
+}
+
+func (d *daemon) list() []shareInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	infos := make([]shareInfo, 0, len(d.shares))
+	for _, sh := range d.shares {
+		infos = append(infos, d.info(sh))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos
+}
+
+func (d *daemon) get(id string) *share {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.shares[id]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handler serves the API. Shares live until they are deleted or
+// ctx is done.
+func (d *daemon) handler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /shares", func(w http.ResponseWriter, req *http.Request) {
+		var sr shareRequest
+		if err := json.NewDecoder(req.Body).Decode(&sr); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request: %v", err))
+			return
+		}
+		sh, err := d.create(ctx, sr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, d.info(sh))
+	})
+	mux.HandleFunc("GET /shares", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, d.list())
+	})
+	mux.HandleFunc("GET /shares/{id}", func(w http.ResponseWriter, req *http.Request) {
+		sh := d.get(req.PathValue("id"))
+		if sh == nil {
+			writeError(w, http.StatusNotFound, errors.New("No such share"))
+			return
+		}
+		writeJSON(w, http.StatusOK, d.info(sh))
+	})
+	mux.HandleFunc("DELETE /shares/{id}", func(w http.ResponseWriter, req *http.Request) {
+		sh := d.get(req.PathValue("id"))
+		if sh == nil {
+			writeError(w, http.StatusNotFound, errors.New("No such share"))
+			return
+		}
+		if err := sh.service.Stop(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "onionized.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("onionized-%d", os.Getuid()), "onionized.sock")
+}
+
+// listenUnix listens on unix socket at path accessible by the
+// owner only. A socket left by a crashed instance is removed.
+// The socket is created with permissions of umask, so it has to be
+// in a directory accessible by the owner only: anyone who can
+// connect to it can share any file.
+func listenUnix(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() || fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s must be a directory accessible by its owner only", dir)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("onionized is already running at %s", path)
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func main() {
+	var debugFlag = flag.Bool("debug", false,
+		"Show what's happening")
+	var socketPath = flag.String("socket", defaultSocketPath(),
+		"Path to unix socket of the API")
+	var control = flag.String("control-addr", "default://",
+		"Set Tor control address to be used")
+	var controlPasswd = flag.String("control-passwd", "",
+		"Set Tor control auth password")
+	var startTor = flag.Bool("start-tor", false,
+		"start tor ourselves")
+	var torPath = flag.String("tor-path", "",
+		"Path to tor binary to start")
+	flag.Parse()
+
+	d := &daemon{
+		base: onionize.Parameters{
+			Debug:           *debugFlag,
+			ControlPath:     *control,
+			ControlPassword: *controlPasswd,
+		},
+		shares: make(map[string]*share),
+	}
+	// Run tor once for all the shares unless there is one
+	if !*startTor && !isFlagSet("control-addr") {
+		path, err := onionize.DiscoverControlPath()
+		d.base.ControlPath = path
+		*startTor = err != nil
+	}
+	if *startTor {
+		tor, err := onionize.RunTor(*torPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tor.Close()
+		d.base.ControlPath = tor.ControlPath()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	l, err := listenUnix(*socketPath)
+	if err != nil {
+		log.Fatalf("Unable to listen on API socket: %v", err)
+	}
+	defer os.Remove(*socketPath)
+	srv := &http.Server{Handler: d.handler(ctx)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("Listening on %s", *socketPath)
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		log.Print(err)
+	}
+	// Shares are stopped along with ctx: let them finish
+	d.mu.Lock()
+	var services []*onionize.Service
+	for _, sh := range d.shares {
+		services = append(services, sh.service)
+	}
+	d.mu.Unlock()
+	for _, s := range services {
+		<-s.Done()
+	}
+}
+
+// isFlagSet reports whether flag name was passed on command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
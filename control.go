@@ -0,0 +1,150 @@
+// control.go - connect to tor control port.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/nogoegst/bulb"
+)
+
+// Environment variables Tor Browser (and tor launchers alike) set
+// to tell controllers how to reach tor.
+const (
+	envControlIPCPath    = "TOR_CONTROL_IPC_PATH"
+	envControlHost       = "TOR_CONTROL_HOST"
+	envControlPort       = "TOR_CONTROL_PORT"
+	envControlPassword   = "TOR_CONTROL_PASSWD"
+	envControlCookieFile = "TOR_CONTROL_COOKIE_AUTH_FILE"
+)
+
+// controlCandidates returns control addresses to look for tor at,
+// in order: the one from the environment, system tor's control
+// socket (not on Windows, tor has none there), system tor's port
+// and Tor Browser's port.
+func controlCandidates() []string {
+	var cs []string
+	if path := os.Getenv(envControlIPCPath); path != "" {
+		cs = append(cs, "unix://"+path)
+	}
+	if port := os.Getenv(envControlPort); port != "" {
+		host := os.Getenv(envControlHost)
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		cs = append(cs, "tcp://"+net.JoinHostPort(host, port))
+	}
+	if runtime.GOOS != "windows" {
+		cs = append(cs, "unix:///run/tor/control", "unix:///var/run/tor/control")
+	}
+	return append(cs, "tcp://127.0.0.1:9051", "tcp://127.0.0.1:9151")
+}
+
+// DiscoverControlPath returns control address of the first tor
+// found running (see Parameters.ControlPath for what is tried).
+func DiscoverControlPath() (string, error) {
+	cs := controlCandidates()
+	for _, c := range cs {
+		if controlReachable(c) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find tor control port (tried %s)", strings.Join(cs, ", "))
+}
+
+// isDefaultControlPath reports whether controlPath asks to look
+// for tor.
+func isDefaultControlPath(controlPath string) bool {
+	return controlPath == "" || controlPath == "default://"
+}
+
+// controlPassword returns password to authenticate with: password
+// or the one from the environment.
+func controlPassword(password string) string {
+	if password == "" {
+		return os.Getenv(envControlPassword)
+	}
+	return password
+}
+
+// authenticate authenticates with tor. bulb picks NULL, SAFECOOKIE
+// or HASHEDPASSWORD (in that order) itself. If the cookie file
+// can't be read, authenticate falls back to the password and
+// otherwise tells what's wrong with the cookie file. Cookie file
+// from the environment is used if the one tor tells about can't be
+// read (e.g. it's Tor Browser's path inside of a sandbox).
+func authenticate(c *bulb.Conn, password string) error {
+	if pi, err := c.ProtocolInfo(); err == nil && pi.CookieFile != "" {
+		if path := os.Getenv(envControlCookieFile); path != "" && !readable(pi.CookieFile) && readable(path) {
+			// pi is cached by bulb and used by Authenticate
+			pi.CookieFile = path
+		}
+	}
+	err := c.Authenticate(password)
+	if err == nil {
+		return nil
+	}
+	pi, perr := c.ProtocolInfo()
+	if perr != nil || !pi.AuthMethods["SAFECOOKIE"] || pi.CookieFile == "" {
+		return err
+	}
+	f, ferr := os.Open(pi.CookieFile)
+	if ferr == nil {
+		f.Close()
+		return err
+	}
+	// Nothing has been sent to tor yet, so try password
+	if password != "" && pi.AuthMethods["HASHEDPASSWORD"] {
+		if _, perr := c.Request("AUTHENTICATE %s", hex.EncodeToString([]byte(password))); perr == nil {
+			return nil
+		}
+	}
+	if os.IsPermission(ferr) {
+		return fmt.Errorf("%v (make sure you are in the group tor cookie file %s belongs to, e.g. debian-tor)", err, pi.CookieFile)
+	}
+	return err
+}
+
+// dialControl connects to tor control port with p.DialControl or at
+// p.ControlPath.
+func dialControl(p Parameters) (*bulb.Conn, error) {
+	if p.DialControl == nil {
+		return bulb.DialURL(p.ControlPath)
+	}
+	conn, err := p.DialControl()
+	if err != nil {
+		return nil, err
+	}
+	return bulb.NewConn(conn), nil
+}
+
+// controlReachable reports whether tor control port at controlPath
+// can be connected to.
+func controlReachable(controlPath string) bool {
+	c, err := bulb.DialURL(controlPath)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// readable reports whether file at path can be opened for reading.
+func readable(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
@@ -0,0 +1,71 @@
+package onionize
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnIdleDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const deadline = 200 * time.Millisecond
+	s, err := New(ctx, Parameters{
+		Text:             "hi",
+		Listener:         l,
+		ConnIdleDeadline: deadline,
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	// closed reports whether c is closed by the server
+	closed := func(c net.Conn) bool {
+		start := time.Now()
+		// The server may answer 400 before closing
+		_, err := io.ReadAll(c)
+		return err == nil && time.Since(start) < 4*time.Second
+	}
+
+	if !closed(dial()) {
+		t.Error("silent connection is not closed")
+	}
+	c := dial()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHo")
+	if !closed(c) {
+		t.Error("connection stalled in request headers is not closed")
+	}
+
+	// Idle keep-alive connections stay
+	c = dial()
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		time.Sleep(2 * deadline)
+	}
+}
@@ -0,0 +1,115 @@
+// descriptor.go - machine-readable description of a share.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+const descriptorPath = "/.onionize/descriptor.json"
+
+type descriptorFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type descriptor struct {
+	Type      string           `json:"type"`
+	Created   time.Time        `json:"created"`
+	TotalSize int64            `json:"total_size"`
+	Files     []descriptorFile `json:"files"`
+}
+
+// sum returns SHA-256 of file p.
+func (fs *fileServer) sum(p string) ([]byte, error) {
+	f, err := fs.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := copyFile(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (fs *fileServer) checksum(p string) (string, error) {
+	sum, err := fs.sum(p)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+func newDescriptor(fs *fileServer, checksums bool) (*descriptor, error) {
+	d := &descriptor{
+		Type:    fs.kind,
+		Created: time.Now().UTC(),
+		Files:   []descriptorFile{},
+	}
+	err := fs.walk("/", func(p string, fi os.FileInfo) {
+		d.Files = append(d.Files, descriptorFile{Path: p, Size: fi.Size()})
+		d.TotalSize += fi.Size()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if checksums {
+		for i := range d.Files {
+			d.Files[i].SHA256, err = fs.checksum(d.Files[i].Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// descriptorHandler serves descriptor of fs alongside h. Descriptor
+// is built in background, until then requests for it are answered
+// with 503.
+func descriptorHandler(h http.Handler, fs *fileServer, checksums bool) http.Handler {
+	var body []byte
+	var err error
+	ready := make(chan struct{})
+	go func() {
+		defer close(ready)
+		var d *descriptor
+		d, err = newDescriptor(fs, checksums)
+		if err != nil {
+			fs.log.Error("Unable to build share descriptor", "err", err)
+			return
+		}
+		body, err = json.Marshal(d)
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc(descriptorPath, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-ready:
+		default:
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "Descriptor is not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unable to build descriptor", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	mux.Handle("/", h)
+	return mux
+}
@@ -0,0 +1,101 @@
+// digest.go - SHA-256 digests of shared files.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileDigest is a digest of a file of size and modTime. sum is
+// set once done is closed, unless there was an error.
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	done    chan struct{}
+	sum     []byte
+}
+
+// fileDigests computes digests of files in background once they
+// are asked for and keeps them. Files are hashed one at a time.
+type fileDigests struct {
+	fs       *fileServer
+	mu       sync.Mutex
+	m        map[string]*fileDigest
+	sem      chan struct{}
+	computed func(name string, sum []byte)
+}
+
+func newFileDigests(fs *fileServer, computed func(string, []byte)) *fileDigests {
+	return &fileDigests{
+		fs:       fs,
+		m:        make(map[string]*fileDigest),
+		sem:      make(chan struct{}, 1),
+		computed: computed,
+	}
+}
+
+// get returns digest of file name if it's ready and starts
+// computing it otherwise. Digests of changed files are recomputed.
+func (fd *fileDigests) get(name string, fi os.FileInfo) []byte {
+	fd.mu.Lock()
+	d, ok := fd.m[name]
+	if !ok || d.size != fi.Size() || !d.modTime.Equal(fi.ModTime()) {
+		d = &fileDigest{size: fi.Size(), modTime: fi.ModTime(), done: make(chan struct{})}
+		fd.m[name] = d
+		go fd.compute(name, d)
+	}
+	fd.mu.Unlock()
+	select {
+	case <-d.done:
+		return d.sum
+	default:
+		return nil
+	}
+}
+
+func (fd *fileDigests) compute(name string, d *fileDigest) {
+	fd.sem <- struct{}{}
+	defer func() { <-fd.sem }()
+	defer close(d.done)
+	sum, err := fd.fs.sum(name)
+	if err != nil {
+		fd.fs.log.Error("Unable to compute digest", "path", name, "err", err)
+		return
+	}
+	d.sum = sum
+	if fd.computed != nil {
+		fd.computed(name, sum)
+	}
+}
+
+// setHeaders sets Repr-Digest of file name (and Content-Digest
+// unless only a range of it is asked for) and ETag derived from
+// the digest, which lets clients resume downloads with If-Range
+// even if modification times are masked.
+func (fd *fileDigests) setHeaders(w http.ResponseWriter, req *http.Request, name string, fi os.FileInfo) {
+	sum := fd.get(name, fi)
+	if sum == nil {
+		return
+	}
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("Repr-Digest", digest)
+	// Whole file is sent for ranges if If-Range has another ETag
+	ifRange := req.Header.Get("If-Range")
+	stale := strings.HasPrefix(ifRange, `"`) && ifRange != etag || strings.HasPrefix(ifRange, "W/")
+	if req.Header.Get("Range") == "" || stale {
+		w.Header().Set("Content-Digest", digest)
+	}
+	w.Header().Set("ETag", etag)
+}
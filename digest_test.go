@@ -0,0 +1,73 @@
+package onionize
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestRange(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "share")
+	content := strings.Repeat("0123456789", 100)
+	writeFile(t, filepath.Join(dir, "file.txt"), content)
+	link, onion := share(t, newFake(t), Parameters{Pathspec: dir, Slug: true, Digests: true})
+	const path = "/share/file.txt"
+
+	// Files are hashed in background once requested
+	var etag string
+	for deadline := time.Now().Add(5 * time.Second); etag == "" && time.Now().Before(deadline); {
+		resp, body := fetch(t, onion, link.Host, path)
+		if resp.StatusCode != http.StatusOK || body != content {
+			t.Fatalf("GET: %d %q", resp.StatusCode, body)
+		}
+		etag = resp.Header.Get("ETag")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		host    string
+		ifRange string
+		code    int
+		body    string
+	}{
+		{"range", link.Host, "", http.StatusPartialContent, content[10:20]},
+		{"if-range", link.Host, etag, http.StatusPartialContent, content[10:20]},
+		{"stale if-range", link.Host, `"0123456789abcdef0123456789abcdef"`, http.StatusOK, content},
+		{"weak if-range", link.Host, "W/" + etag, http.StatusOK, content},
+		{"no slug", onion.ID + ".onion", etag, http.StatusNotFound, ""},
+		{"wrong slug", "wrongslug." + onion.ID + ".onion", etag, http.StatusNotFound, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newOnionRequest(t, "GET", tc.host, path)
+			req.Header.Set("Range", "bytes=10-19")
+			if tc.ifRange != "" {
+				req.Header.Set("If-Range", tc.ifRange)
+			}
+			resp, body := do(t, onion, req)
+			if resp.StatusCode != tc.code {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tc.code)
+			}
+			if tc.code == http.StatusNotFound {
+				if resp.Header.Get("Repr-Digest") != "" || resp.Header.Get("ETag") != "" {
+					t.Fatal("digest of file is sent on miss")
+				}
+				return
+			}
+			if body != tc.body {
+				t.Fatalf("got %q, want %q", body, tc.body)
+			}
+			if resp.Header.Get("ETag") != etag || resp.Header.Get("Repr-Digest") == "" {
+				t.Fatalf("ETag %q, Repr-Digest %q", resp.Header.Get("ETag"), resp.Header.Get("Repr-Digest"))
+			}
+			if partial := tc.code == http.StatusPartialContent; partial == (resp.Header.Get("Content-Digest") != "") {
+				t.Fatalf("Content-Digest %q of partial (%v) response", resp.Header.Get("Content-Digest"), partial)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// events.go - lifecycle events of shares.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Event is a lifecycle event of a share: OnionPublished,
+// ClientConnected, RequestReceived, DownloadProgress,
+// DownloadCompleted, DigestComputed, UploadProgress, FileReceived,
+// TorConnectionLost or TorReconnected.
+type Event interface {
+	event()
+}
+
+// OnionPublished is sent once the share is reachable at URL.
+type OnionPublished struct {
+	URL url.URL
+}
+
+// ClientConnected is sent for every new connection. Every
+// connection via onion service is a stream of a client circuit
+// and comes from tor, so RemoteAddr tells nothing about the client.
+type ClientConnected struct {
+	RemoteAddr string
+}
+
+// RequestReceived is sent for every request that passed the checks
+// (slug, required header).
+type RequestReceived struct {
+	URL        string
+	RemoteAddr string
+}
+
+// DownloadProgress is sent while content at URL is being sent with
+// the number of bytes sent and total size of content (-1 if
+// unknown).
+type DownloadProgress struct {
+	URL   string
+	Bytes int64
+	Total int64
+}
+
+// DownloadCompleted is sent once content at URL was completely sent.
+type DownloadCompleted struct {
+	URL   string
+	Bytes int64
+}
+
+// DigestComputed is sent once SHA-256 of file at Path is computed
+// (see Parameters.Digests).
+type DigestComputed struct {
+	Path string
+	// SHA256 is hex-encoded
+	SHA256 string
+}
+
+// UploadProgress is sent while file Name is being received
+// (see Parameters.ReceiveDir) with the number of bytes received.
+type UploadProgress struct {
+	Name  string
+	Bytes int64
+}
+
+// FileReceived is sent once file Name is received.
+type FileReceived struct {
+	Name  string
+	Bytes int64
+}
+
+// TorConnectionLost is sent when the connection to tor is lost.
+// The share stops then unless Parameters.ReconnectTor is set: the
+// share is unreachable until TorReconnected.
+type TorConnectionLost struct {
+	Err error
+}
+
+// TorReconnected is sent once the onion is published again after
+// TorConnectionLost.
+type TorReconnected struct{}
+
+func (OnionPublished) event()    {}
+func (ClientConnected) event()   {}
+func (RequestReceived) event()   {}
+func (DownloadProgress) event()  {}
+func (DownloadCompleted) event() {}
+func (DigestComputed) event()    {}
+func (UploadProgress) event()    {}
+func (FileReceived) event()      {}
+func (TorConnectionLost) event() {}
+func (TorReconnected) event()    {}
+
+// emit sends e to events channel unless it would block.
+func (s *Service) emit(e Event) {
+	if s.events == nil {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+	}
+}
+
+// requestEvents emits RequestReceived for requests to h and counts
+// them (by status of response) and bytes sent in response.
+func (s *Service) requestEvents(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.stats.requests.Add(1)
+		s.emit(RequestReceived{
+			URL:        req.URL.String(),
+			RemoteAddr: req.RemoteAddr,
+		})
+		sw := &statusWriter{ResponseWriter: &countingWriter{w, &s.stats.bytesSent}}
+		h.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.stats.statuses.add(sw.status)
+	})
+}
+
+// connState emits ClientConnected for new connections and keeps
+// track of open ones.
+func (s *Service) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.stats.active.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		s.stats.active.Add(-1)
+		return
+	default:
+		return
+	}
+	s.stats.connections.Add(1)
+	s.emit(ClientConnected{RemoteAddr: conn.RemoteAddr().String()})
+}
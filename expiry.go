@@ -0,0 +1,49 @@
+// expiry.go - tell clients when the share expires.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const expiryPath = "/.onionize/expiry"
+
+// expiry is the time the share expires at. It is set once
+// the share has been published.
+type expiry struct {
+	at time.Time
+}
+
+type expiryInfo struct {
+	Expires   time.Time `json:"expires"`
+	Remaining float64   `json:"remaining"`
+}
+
+// expiryHandler adds share expiry time to responses of h
+// and serves it as JSON at expiryPath.
+func expiryHandler(h http.Handler, e *expiry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Share-Expires", e.at.UTC().Format(time.RFC3339))
+		if req.URL.Path != expiryPath {
+			h.ServeHTTP(w, req)
+			return
+		}
+		remaining := time.Until(e.at)
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(expiryInfo{
+			Expires:   e.at.UTC(),
+			Remaining: remaining.Seconds(),
+		})
+	})
+}
@@ -0,0 +1,545 @@
+// faketor.go - fake tor control port for testing.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+// Package faketor implements a fake tor control port which speaks
+// enough of the control protocol for onionize to publish onions
+// with it: PROTOCOLINFO, AUTHENTICATE, ADD_ONION, DEL_ONION,
+// SETEVENTS HS_DESC and a few others. Nothing is published for
+// real; instead, onions are kept by the server so tests can look at
+// them and connect to their targets directly.
+//
+//	ft, err := faketor.New()
+//	...
+//	defer ft.Close()
+//	links := make(chan onionize.ResultLink, 1)
+//	go onionize.Onionize(ctx, onionize.Parameters{
+//		DialControl: ft.Dial,
+//		...
+//	}, links)
+//	link := <-links
+package faketor
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hsDir is reported as the HSDir descriptors are uploaded to.
+const hsDir = "$0123456789ABCDEF0123456789ABCDEF01234567~fakehsdir"
+
+// Onion is an onion service added to the server.
+type Onion struct {
+	// ID is the onion address without ".onion".
+	ID string
+	// Ports maps virtual ports to their targets.
+	Ports map[int]string
+	// Flags are flags of ADD_ONION, e.g. "Detach".
+	Flags []string
+	// ClientAuth are names of v2 clients given.
+	ClientAuth []string
+	// ClientAuthV3 are keys of v3 clients given.
+	ClientAuthV3 []string
+}
+
+// Target returns target of virtual port of the onion ("" if the
+// port isn't there).
+func (o Onion) Target(port int) string {
+	return o.Ports[port]
+}
+
+// Detached reports whether the onion outlives its control
+// connection.
+func (o Onion) Detached() bool {
+	return slices.Contains(o.Flags, "Detach")
+}
+
+// Server is a fake tor control port.
+type Server struct {
+	// Password makes the server require HASHEDPASSWORD
+	// authentication with it instead of NULL. It must be set
+	// before connecting to the server.
+	Password string
+
+	l      net.Listener
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	onions map[string]*Onion
+	owners map[string]net.Conn
+	closed bool
+}
+
+// New returns a server listening on a random loopback TCP port.
+func New() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen: %v", err)
+	}
+	s := &Server{
+		l:      l,
+		conns:  make(map[net.Conn]bool),
+		onions: make(map[string]*Onion),
+		owners: make(map[string]net.Conn),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns address the server listens on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// ControlPath returns control address of the server to use as
+// ControlPath of onionize.
+func (s *Server) ControlPath() string {
+	return "tcp://" + s.Addr()
+}
+
+// Dial connects to the server over an in-memory pipe. It fits
+// DialControl of onionize.
+func (s *Server) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	if !s.serve(server) {
+		client.Close()
+		return nil, fmt.Errorf("Server is closed")
+	}
+	return client, nil
+}
+
+// Onions returns onions the server has now, sorted by ID.
+func (s *Server) Onions() []Onion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var onions []Onion
+	for _, id := range slices.Sorted(maps.Keys(s.onions)) {
+		onions = append(onions, *s.onions[id])
+	}
+	return onions
+}
+
+// Onion returns onion id if the server has it.
+func (s *Server) Onion(id string) (Onion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.onions[id]
+	if !ok {
+		return Onion{}, false
+	}
+	return *o, true
+}
+
+// DropConnections closes all control connections as if tor was
+// restarted. Onions which are not detached are gone with them.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server, closes its connections and waits for
+// them to be over.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.l.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// serve serves conn in background. It returns false if the server
+// is closed.
+func (s *Server) serve(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		sc := &session{s: s, conn: conn, r: textproto.NewReader(bufio.NewReader(conn))}
+		sc.run()
+		conn.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.conns, conn)
+		for id, owner := range s.owners {
+			if owner == conn {
+				delete(s.onions, id)
+				delete(s.owners, id)
+			}
+		}
+	}()
+	return true
+}
+
+// session is a control connection.
+type session struct {
+	s             *Server
+	conn          net.Conn
+	r             *textproto.Reader
+	authenticated bool
+	hsDesc        bool
+}
+
+// run handles commands until the connection is over.
+func (sc *session) run() {
+	for {
+		line, err := sc.r.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, args, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+		if !sc.authenticated {
+			switch cmd {
+			case "PROTOCOLINFO", "AUTHENTICATE", "QUIT":
+			default:
+				sc.reply("514 Authentication required.")
+				return
+			}
+		}
+		var lines, events []string
+		switch cmd {
+		case "PROTOCOLINFO":
+			lines = sc.protocolInfo()
+		case "AUTHENTICATE":
+			lines = sc.authenticate(args)
+		case "ADD_ONION":
+			var id string
+			lines, id = sc.addOnion(strings.Fields(args))
+			if id != "" {
+				events = sc.uploads(id)
+			}
+		case "DEL_ONION":
+			lines = sc.delOnion(strings.TrimSpace(args))
+		case "SETEVENTS":
+			lines = sc.setEvents(strings.Fields(args))
+			events = sc.uploads(sc.onionIDs()...)
+		case "GETINFO":
+			lines = sc.getInfo(strings.Fields(args))
+		case "TAKEOWNERSHIP", "SETCONF", "RESETCONF", "SIGNAL":
+			lines = []string{"250 OK"}
+		case "QUIT":
+			sc.reply("250 closing connection")
+			return
+		default:
+			lines = []string{fmt.Sprintf("510 Unrecognized command %q", cmd)}
+		}
+		if err := sc.reply(lines...); err != nil {
+			return
+		}
+		for _, ev := range events {
+			if err := sc.reply(ev); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply writes reply lines. All but the last one are mid reply
+// lines, e.g. "250-ServiceID=..." (status only is given), unless
+// they are data reply lines ("250+...").
+func (sc *session) reply(lines ...string) error {
+	var b strings.Builder
+	for i, l := range lines {
+		if i != len(lines)-1 && l[3] != '+' {
+			l = l[:3] + "-" + l[4:]
+		}
+		b.WriteString(l + "\r\n")
+	}
+	_, err := io.WriteString(sc.conn, b.String())
+	return err
+}
+
+func (sc *session) protocolInfo() []string {
+	methods := "NULL"
+	if sc.s.Password != "" {
+		methods = "HASHEDPASSWORD"
+	}
+	return []string{
+		"250 PROTOCOLINFO 1",
+		"250 AUTH METHODS=" + methods,
+		`250 VERSION Tor="0.4.8.10"`,
+		"250 OK",
+	}
+}
+
+func (sc *session) authenticate(arg string) []string {
+	arg = strings.TrimSpace(arg)
+	password, err := strconv.Unquote(arg)
+	if err != nil {
+		b, herr := hex.DecodeString(arg)
+		if herr != nil {
+			return []string{"551 Invalid hexadecimal encoding.  Maybe you tried a plain text password?  If so, the standard requires that you put it in double quotes."}
+		}
+		password = string(b)
+	}
+	if sc.s.Password != "" && password != sc.s.Password {
+		return []string{"515 Authentication failed: Password did not match HashedControlPassword value from configuration"}
+	}
+	sc.authenticated = true
+	return []string{"250 OK"}
+}
+
+// addOnion adds an onion and returns its ID as well if it's
+// added.
+func (sc *session) addOnion(args []string) ([]string, string) {
+	if len(args) == 0 {
+		return []string{"512 Missing argument to ADD_ONION"}, ""
+	}
+	id, privateKey, err := onionKey(args[0])
+	if err != nil {
+		return []string{"513 " + err.Error()}, ""
+	}
+	o := &Onion{ID: id, Ports: make(map[int]string)}
+	for _, arg := range args[1:] {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "Flags":
+			o.Flags = strings.Split(value, ",")
+		case "Port":
+			port, target, err := portSpec(value)
+			if err != nil {
+				return []string{"512 " + err.Error()}, ""
+			}
+			o.Ports[port] = target
+		case "ClientAuth":
+			o.ClientAuth = append(o.ClientAuth, value)
+		case "ClientAuthV3":
+			o.ClientAuthV3 = append(o.ClientAuthV3, value)
+		default:
+			return []string{fmt.Sprintf("513 Invalid argument %q", arg)}, ""
+		}
+	}
+	if len(o.Ports) == 0 {
+		return []string{"512 Missing 'Port' argument"}, ""
+	}
+	lines := []string{"250 ServiceID=" + id}
+	if privateKey != "" && !slices.Contains(o.Flags, "DiscardPK") {
+		lines = append(lines, "250 PrivateKey="+privateKey)
+	}
+	for _, name := range o.ClientAuth {
+		if !slices.Contains(o.Flags, "BasicAuth") {
+			return []string{"512 Cannot specify ClientAuth without BasicAuth flag"}, ""
+		}
+		cookie := make([]byte, 16)
+		rand.Read(cookie)
+		lines = append(lines, fmt.Sprintf("250 ClientAuth=%s:%s", name, base64.RawStdEncoding.EncodeToString(cookie)))
+	}
+	s := sc.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.onions[id]; ok {
+		return []string{"550 Onion address collision"}, ""
+	}
+	s.onions[id] = o
+	if !o.Detached() {
+		s.owners[id] = sc.conn
+	}
+	return append(lines, "250 OK"), id
+}
+
+func (sc *session) delOnion(id string) []string {
+	s := sc.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner, owned := s.owners[id]
+	if _, ok := s.onions[id]; !ok || (owned && owner != sc.conn) {
+		return []string{"552 Unknown Onion Service id"}
+	}
+	delete(s.onions, id)
+	delete(s.owners, id)
+	return []string{"250 OK"}
+}
+
+func (sc *session) setEvents(events []string) []string {
+	// Other events are accepted but never sent
+	sc.hsDesc = slices.ContainsFunc(events, func(ev string) bool {
+		return strings.EqualFold(ev, "HS_DESC")
+	})
+	return []string{"250 OK"}
+}
+
+// onionIDs returns IDs of onions the session can see: its own and
+// detached ones.
+func (sc *session) onionIDs() []string {
+	s := sc.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, o := range s.onions {
+		if owner, owned := s.owners[id]; o.Detached() || (owned && owner == sc.conn) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// ownOnionIDs returns IDs of onions added by the session which
+// are gone with it.
+func (sc *session) ownOnionIDs() []string {
+	s := sc.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, owner := range s.owners {
+		if owner == sc.conn {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// detachedOnionIDs returns IDs of detached onions.
+func (sc *session) detachedOnionIDs() []string {
+	s := sc.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, o := range s.onions {
+		if o.Detached() {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// uploads returns events of descriptor uploads of onions ids if
+// the session is interested in them.
+func (sc *session) uploads(ids ...string) []string {
+	if !sc.hsDesc {
+		return nil
+	}
+	var events []string
+	for _, id := range ids {
+		events = append(events, fmt.Sprintf("650 HS_DESC UPLOADED %s UNKNOWN %s", id, hsDir))
+	}
+	return events
+}
+
+func (sc *session) getInfo(keys []string) []string {
+	var lines []string
+	for _, key := range keys {
+		switch key {
+		case "onions/current":
+			lines = append(lines, infoList(key, sc.ownOnionIDs()))
+		case "onions/detached":
+			lines = append(lines, infoList(key, sc.detachedOnionIDs()))
+		case "version":
+			lines = append(lines, "250 version=0.4.8.10")
+		case "status/bootstrap-phase":
+			lines = append(lines, `250 status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`)
+		default:
+			return []string{fmt.Sprintf("552 Unrecognized key %q", key)}
+		}
+	}
+	return append(lines, "250 OK")
+}
+
+// infoList returns GETINFO reply line of key with values, one per
+// line as tor sends them.
+func infoList(key string, values []string) string {
+	if len(values) < 2 {
+		return fmt.Sprintf("250 %s=%s", key, strings.Join(values, ""))
+	}
+	return fmt.Sprintf("250+%s=\r\n%s\r\n.", key, strings.Join(values, "\r\n"))
+}
+
+// portSpec parses value of Port argument of ADD_ONION.
+func portSpec(value string) (int, string, error) {
+	virt, target, hasTarget := strings.Cut(value, ",")
+	port, err := strconv.Atoi(virt)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, "", fmt.Errorf("Invalid VIRTPORT/TARGET")
+	}
+	switch {
+	case !hasTarget:
+		target = "127.0.0.1:" + virt
+	case !strings.Contains(target, ":"):
+		target = "127.0.0.1:" + target
+	}
+	return port, target, nil
+}
+
+// onionKey returns onion address of key argument of ADD_ONION and
+// private key to tell about if it's a new one.
+func onionKey(arg string) (id, privateKey string, err error) {
+	typ, blob, ok := strings.Cut(arg, ":")
+	if !ok {
+		return "", "", fmt.Errorf("Invalid key type")
+	}
+	if typ == "NEW" {
+		switch blob {
+		case "BEST", "ED25519-V3":
+			typ = "ED25519-V3"
+			b := newExpandedKey()
+			blob = base64.StdEncoding.EncodeToString(b)
+		case "RSA1024":
+			typ = "RSA1024"
+			k, err := rsa.GenerateKey(rand.Reader, 1024)
+			if err != nil {
+				return "", "", fmt.Errorf("Unable to generate key")
+			}
+			blob = base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PrivateKey(k))
+		default:
+			return "", "", fmt.Errorf("Invalid key type")
+		}
+		privateKey = typ + ":" + blob
+	}
+	b, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to decode %s key", typ)
+	}
+	switch typ {
+	case "ED25519-V3":
+		id, err = addressV3(b)
+	case "RSA1024":
+		id, err = addressV2(b)
+	default:
+		err = fmt.Errorf("Invalid key type")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return id, privateKey, nil
+}
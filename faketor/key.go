@@ -0,0 +1,49 @@
+// key.go - onion addresses of keys given to fake tor.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package faketor
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/nogoegst/onionize/internal/edkey"
+	"github.com/nogoegst/onionutil"
+	"golang.org/x/crypto/ed25519"
+)
+
+// addressV3 returns onion address of expanded ed25519 key.
+func addressV3(expanded []byte) (string, error) {
+	pk, err := edkey.PublicKey(expanded)
+	if err != nil {
+		return "", err
+	}
+	return onionutil.OnionAddressV3(pk)
+}
+
+// addressV2 returns onion address of PKCS#1 RSA key.
+func addressV2(der []byte) (string, error) {
+	k, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode RSA1024 key")
+	}
+	return onionutil.OnionAddressV2(&k.PublicKey)
+}
+
+// newExpandedKey generates an expanded ed25519 secret key the way
+// tor does.
+func newExpandedKey() []byte {
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:]
+}
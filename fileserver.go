@@ -0,0 +1,397 @@
+// fileserver.go - serve directories, files and zip archives.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nogoegst/pickfs"
+	"golang.org/x/tools/godoc/vfs"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// splitQuoted splits s by sep if it is found outside substring
+// quoted by quote.
+func splitQuoted(s string, quote, sep rune) (splitted []string) {
+	quoteFlag := false
+NewSubstring:
+	for i, c := range s {
+		if c == quote {
+			quoteFlag = !quoteFlag
+		}
+		if c == sep && !quoteFlag {
+			splitted = append(splitted, s[:i])
+			s = s[i+1:]
+			goto NewSubstring
+		}
+	}
+	return append(splitted, s)
+}
+
+const delimeter = ';'
+
+// JoinPathspec joins paths (with optional ":alias" suffixes)
+// into a single pathspec.
+func JoinPathspec(paths []string) string {
+	return strings.Join(paths, string(delimeter))
+}
+
+func parsePathspec(pathspec string) (map[string]string, error) {
+	aliasmap := make(map[string]string)
+	paths := splitQuoted(pathspec, '"', delimeter)
+	for _, p := range paths {
+		spath := strings.Split(p, ":")
+		var alias string
+		switch len(spath) {
+		case 1:
+			_, alias = filepath.Split(filepath.Clean(spath[0]))
+			if alias == "." && len(paths) != 1 {
+				return nil, errors.New("current working dir doesnt't have an alias")
+			}
+		case 2:
+			alias = spath[1]
+		default:
+			return nil, errors.New("invalid filespec: too many delimeters")
+		}
+		abs, err := filepath.Abs(spath[0])
+		if err != nil {
+			return nil, err
+		}
+		alias = path.Clean(filepath.ToSlash(alias))
+		if other, ok := aliasmap[alias]; ok {
+			return nil, fmt.Errorf("%s and %s are both shared as %q", other, abs, alias)
+		}
+		aliasmap[alias] = abs
+	}
+	return aliasmap, nil
+}
+
+// pathsAliasmap maps basenames of paths to their absolute paths.
+func pathsAliasmap(paths []string) (map[string]string, error) {
+	aliasmap := make(map[string]string)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		alias := filepath.Base(abs)
+		if other, ok := aliasmap[alias]; ok {
+			return nil, fmt.Errorf("%s and %s are both shared as %q", other, abs, alias)
+		}
+		aliasmap[alias] = abs
+	}
+	return aliasmap, nil
+}
+
+// shareAliasmap returns mapping of shared paths of p to their
+// names in the share.
+func shareAliasmap(p Parameters) (map[string]string, error) {
+	if len(p.Paths) != 0 {
+		return pathsAliasmap(p.Paths)
+	}
+	return parsePathspec(p.Pathspec)
+}
+
+// aliasFS returns filesystem with paths of aliasmap under their
+// aliases. The current directory is shared as the root.
+func aliasFS(aliasmap map[string]string) vfs.FileSystem {
+	if _, ok := aliasmap["."]; ok {
+		return vfs.OS(".")
+	}
+	return pickfs.New(vfs.OS(""), aliasmap)
+}
+
+// escapePath escapes p to be used as a path of URL. Unlike
+// url.QueryEscape it keeps slashes and encodes spaces as "%20".
+func escapePath(p string) string {
+	u := url.URL{Path: p}
+	return u.EscapedPath()
+}
+
+// fileServer serves files from vfs. vfs.FileSystem has no means of
+// modification, so served content is never written to: it is safe to
+// serve from read-only and overlay mounts. Anything onionize keeps
+// on the side (listings, descriptor) lives in memory.
+type fileServer struct {
+	fs                 vfs.FileSystem
+	handler            http.Handler
+	traverseLonelyPath bool
+	log                *slog.Logger
+	listings           *listingCache
+	// kind of the share: "file", "directory", "zip", "tar" or "fs"
+	kind    string
+	heads   *headTracker
+	noIndex bool
+	// forceDownload asks browsers to save the file of "file" shares
+	forceDownload bool
+	// contentType overrides type of the file of "file" shares
+	contentType string
+	// zipDownloads serves directories as zip archives on
+	// "?download=zip"
+	zipDownloads bool
+	// maskModTimes leaves modification times out of zip archives
+	maskModTimes bool
+	templates    *template.Template
+	// landing serves landing page of "file" shares at the root
+	landing bool
+	digests *fileDigests
+}
+
+// newFileServer creates new handler that serves files from
+// p.FileSystem, p.FS or p.Content or, if none is set, from p.Paths
+// or p.Pathspec.
+// Serves from the archive if p.Zip is set.
+func newFileServer(p Parameters, emit func(Event)) (*fileServer, error) {
+	fs := &fileServer{
+		traverseLonelyPath: true,
+		log:                logger(p),
+		noIndex:            p.NoIndex,
+		forceDownload:      p.ForceDownload,
+		contentType:        p.ContentType,
+		zipDownloads:       p.ZipDownloads,
+		maskModTimes:       p.MaskModTimes,
+		templates:          p.Templates,
+		landing:            p.LandingPage,
+	}
+	if p.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(p.ContentType); err != nil {
+			return nil, fmt.Errorf("Invalid content type %q: %v", p.ContentType, err)
+		}
+	}
+	if p.CacheListings {
+		fs.listings = newListingCache()
+	}
+	if p.RequireHeadFirst {
+		fs.heads = newHeadTracker()
+	}
+	if p.FileSystem != nil {
+		fs.fs = p.FileSystem
+		fs.kind = "fs"
+	} else if p.FS != nil {
+		fs.fs = newIOFS(p.FS)
+		fs.kind = "fs"
+	} else if p.Content != nil {
+		if p.ContentName == "" || strings.ContainsAny(p.ContentName, `/\`) {
+			return nil, fmt.Errorf("Invalid content name: %q", p.ContentName)
+		}
+		b, err := io.ReadAll(p.Content)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read content: %v", err)
+		}
+		fs.fs = mapfs.New(map[string]string{p.ContentName: string(b)})
+		fs.kind = "file"
+	} else if p.Zip {
+		// Serve contents of the archive
+		var err error
+		fs.fs, fs.kind, err = openArchive(p.Pathspec)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		aliasmap, err := shareAliasmap(p)
+		if err != nil {
+			return nil, err
+		}
+		fs.fs = aliasFS(aliasmap)
+		fs.kind = "directory"
+		if len(aliasmap) == 1 {
+			for _, realpath := range aliasmap {
+				if fi, err := os.Stat(realpath); err == nil && !fi.IsDir() {
+					fs.kind = "file"
+				}
+			}
+		}
+		if _, ok := aliasmap["."]; ok {
+			fs.traverseLonelyPath = false
+		}
+	}
+	if p.MaskModTimes {
+		fs.fs = maskedFS{fs.fs}
+	}
+	if p.CacheListings {
+		fs.fs = newMetaCache(fs.fs)
+	}
+	fs.handler = http.FileServer(httpfs.New(fs.fs))
+	if p.Digests {
+		fs.digests = newFileDigests(fs, func(name string, sum []byte) {
+			emit(DigestComputed{Path: name, SHA256: hex.EncodeToString(sum)})
+		})
+		// The file is likely to be downloaded as a whole
+		if fs.kind == "file" {
+			lpath := fs.lonelyPath()
+			if fi, err := fs.fs.Stat(lpath); err == nil && !fi.IsDir() {
+				fs.digests.get(lpath, fi)
+			}
+		}
+	}
+	return fs, nil
+}
+
+// lonelyPath descends from the root while directories contain
+// exactly one entry and returns the resulting path.
+func (fs *fileServer) lonelyPath() string {
+	lpath := "/"
+	for {
+		fi, err := fs.fs.ReadDir(lpath)
+		if err != nil || len(fi) != 1 {
+			break
+		}
+		lpath = path.Join(lpath, fi[0].Name())
+	}
+	return lpath
+}
+
+func (fs *fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fs.log.Debug("Request", "path", req.URL.Path, "remote", req.RemoteAddr)
+	if fs.landing && fs.kind == "file" && req.URL.Path == "/" {
+		lpath := fs.lonelyPath()
+		if fi, err := fs.fs.Stat(lpath); err == nil && !fi.IsDir() {
+			fs.serveLanding(w, req, lpath, fi)
+			return
+		}
+	}
+	// Traverse lonely path
+	if fs.traverseLonelyPath && req.URL.Path == "/" {
+		if lpath := fs.lonelyPath(); lpath != "/" {
+			http.Redirect(w, req, escapePath(lpath), http.StatusFound)
+			return
+		}
+	}
+	if fs.heads != nil {
+		name := path.Clean(req.URL.Path)
+		if fi, err := fs.fs.Stat(name); err == nil && !fi.IsDir() {
+			if !fs.heads.check(w, req, name) {
+				return
+			}
+		}
+	}
+	if fs.noIndex && fs.isListing(path.Clean(req.URL.Path)) {
+		http.NotFound(w, req)
+		return
+	}
+	if !fs.noIndex && fs.isZip(req) {
+		fs.serveZip(w, req, path.Clean(req.URL.Path))
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/") {
+		name := path.Clean(req.URL.Path)
+		if fs.isListing(name) {
+			fs.serveListing(w, req, name)
+			return
+		}
+	}
+	if fs.digests != nil {
+		name := path.Clean(req.URL.Path)
+		if fi, err := fs.fs.Stat(name); err == nil && !fi.IsDir() {
+			fs.digests.setHeaders(w, req, name, fi)
+		}
+	}
+	if fs.kind == "file" && (fs.forceDownload || fs.contentType != "") && fs.isFile(req) {
+		if fs.forceDownload {
+			w.Header().Set("Content-Disposition", attachment(path.Base(path.Clean(req.URL.Path))))
+		}
+		if fs.contentType != "" {
+			// Don't let browsers second-guess it
+			w.Header().Set("Content-Type", fs.contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+	}
+	fs.handler.ServeHTTP(w, req)
+}
+
+// attachment returns Content-Disposition value making browsers save
+// the response as name. Names which are not plain ASCII (or contain
+// "%" some browsers unescape) are given as filename* of RFC 6266,
+// with an ASCII approximation as filename for older clients.
+func attachment(name string) string {
+	plain := true
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f || r == '%' || r == '"' || r == '\\' {
+			plain = false
+			return '_'
+		}
+		return r
+	}, name)
+	if plain {
+		return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	}
+	var ext strings.Builder
+	for _, b := range []byte(name) {
+		if b < 0x80 && (b >= '0' && b <= '9' || b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0) {
+			ext.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, ext.String())
+}
+
+// isListing reports whether a request for directory name
+// should be answered with a directory listing.
+func (fs *fileServer) isListing(name string) bool {
+	fi, err := fs.fs.Stat(name)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	// http.FileServer serves index.html instead of listing
+	_, err = fs.fs.Stat(path.Join(name, "index.html"))
+	return err != nil
+}
+
+// isFile reports whether req is for a file.
+func (fs *fileServer) isFile(req *http.Request) bool {
+	fi, err := fs.fs.Stat(path.Clean(req.URL.Path))
+	return err == nil && !fi.IsDir()
+}
+
+// walk calls fn for every file under directory dir.
+func (fs *fileServer) walk(dir string, fn func(p string, fi os.FileInfo)) error {
+	return walkFS(fs.fs, dir, fn)
+}
+
+// walkFS calls fn for every file of fsys under directory dir.
+func walkFS(fsys vfs.FileSystem, dir string, fn func(p string, fi os.FileInfo)) error {
+	fis, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		p := path.Join(dir, fi.Name())
+		symlink := fi.Mode()&os.ModeSymlink != 0
+		// pickfs lists aliases as fake entries, so stat them
+		fi, err := fsys.Stat(p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// Don't follow symlinks to directories to avoid loops
+			if symlink {
+				continue
+			}
+			if err := walkFS(fsys, p, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		fn(p, fi)
+	}
+	return nil
+}
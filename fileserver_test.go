@@ -0,0 +1,186 @@
+package onionize
+
+import (
+	"archive/zip"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var trickyNames = []string{
+	"a b.txt",
+	"ünïcödé файл.txt",
+	"a+b.txt",
+	"a#b.txt",
+	"100%.txt",
+	"100%25.txt",
+	"what?.txt",
+	"a&b=c.txt",
+	"semi;colon.txt",
+}
+
+// get serves GET of target (path with optional query) with h.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+// follow serves GET of target and then of where it's redirected
+// to, as a browser would.
+func follow(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	for i := 0; i < 5; i++ {
+		w := get(h, target)
+		loc := w.Header().Get("Location")
+		if w.Code/100 != 3 || loc == "" {
+			return w
+		}
+		base, _ := url.Parse(target)
+		u, err := base.Parse(loc)
+		if err != nil {
+			t.Fatalf("redirect of %s to invalid %q: %v", target, loc, err)
+		}
+		target = u.RequestURI()
+	}
+	t.Fatalf("too many redirects from %s", target)
+	return nil
+}
+
+func newTestFileServer(t *testing.T, p Parameters) *fileServer {
+	t.Helper()
+	fs, err := newFileServer(p, func(Event) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestEscapePath(t *testing.T) {
+	for _, name := range trickyNames {
+		u, err := url.Parse("/" + escapePath(name))
+		if err != nil {
+			t.Fatalf("escaped %q doesn't parse: %v", name, err)
+		}
+		if u.Path != "/"+name || u.RawQuery != "" || u.Fragment != "" {
+			t.Errorf("%q escaped as %q is read back as path %q, query %q, fragment %q",
+				name, escapePath(name), u.Path, u.RawQuery, u.Fragment)
+		}
+	}
+}
+
+func TestLonelyFileRedirect(t *testing.T) {
+	for _, name := range trickyNames {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			content := "content of " + name
+			path := filepath.Join(dir, name)
+			writeFile(t, path, content)
+			archive := filepath.Join(dir, "archive.zip")
+			writeZip(t, archive, map[string]string{name: content})
+			for _, backend := range []struct {
+				name string
+				p    Parameters
+			}{
+				{"file", Parameters{Pathspec: path}},
+				{"paths", Parameters{Paths: []string{path}}},
+				{"zip", Parameters{Pathspec: archive, Zip: true}},
+			} {
+				if backend.name == "file" && strings.ContainsRune(name, delimeter) {
+					// It's two paths in a pathspec
+					continue
+				}
+				w := follow(t, newTestFileServer(t, backend.p), "/")
+				if w.Code != http.StatusOK || w.Body.String() != content {
+					t.Errorf("%s: got %d %q, want %q", backend.name, w.Code, w.Body.String(), content)
+				}
+			}
+		})
+	}
+}
+
+var hrefRe = regexp.MustCompile(`<a href="(\./[^"]*)">`)
+
+func TestListingLinks(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for _, name := range trickyNames {
+		files[name] = "content of " + name
+		writeFile(t, filepath.Join(dir, "share", name), files[name])
+	}
+	archive := filepath.Join(dir, "archive.zip")
+	writeZip(t, archive, files)
+	for _, backend := range []struct {
+		name    string
+		p       Parameters
+		listing string
+	}{
+		{"directory", Parameters{Pathspec: filepath.Join(dir, "share")}, "/share/"},
+		{"zip", Parameters{Pathspec: archive, Zip: true}, "/"},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			fs := newTestFileServer(t, backend.p)
+			w := get(fs, backend.listing)
+			if w.Code != http.StatusOK {
+				t.Fatalf("listing: %d", w.Code)
+			}
+			served := make(map[string]bool)
+			for _, m := range hrefRe.FindAllStringSubmatch(w.Body.String(), -1) {
+				href := html.UnescapeString(m[1])
+				base, _ := url.Parse(backend.listing)
+				u, err := base.Parse(href)
+				if err != nil {
+					t.Fatalf("invalid link %q: %v", href, err)
+				}
+				fw := get(fs, u.RequestURI())
+				name := filepath.Base(u.Path)
+				if fw.Code != http.StatusOK || fw.Body.String() != files[name] {
+					t.Errorf("link %q: got %d %q, want %q", href, fw.Code, fw.Body.String(), files[name])
+				}
+				served[name] = true
+			}
+			for _, name := range trickyNames {
+				if !served[name] {
+					t.Errorf("no working link to %q", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// forward.go - forward onion ports to local addresses.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nogoegst/bulb"
+)
+
+// PortForward maps port of the onion service to a local target.
+// Connections are forwarded by tor itself, so anything that runs
+// over TCP (e.g. SSH) can be forwarded.
+type PortForward struct {
+	VirtPort uint16
+	// Target is a local port, host:port or unix:path of a unix
+	// socket.
+	Target string
+}
+
+// ParsePortForward parses port forward in form of
+// "virtport:target" (e.g. "22:127.0.0.1:22" or
+// "80:unix:/run/app.sock"). Sole "port" forwards the port of the
+// onion service to the same local port.
+func ParsePortForward(s string) (PortForward, error) {
+	virt, target, ok := strings.Cut(s, ":")
+	if !ok {
+		target = virt
+	}
+	port, err := strconv.ParseUint(virt, 10, 16)
+	if err != nil || port == 0 {
+		return PortForward{}, fmt.Errorf("Invalid onion port of forward %q", s)
+	}
+	f := PortForward{VirtPort: uint16(port), Target: target}
+	if err := f.validate(); err != nil {
+		return PortForward{}, err
+	}
+	return f, nil
+}
+
+func (f PortForward) validate() error {
+	if f.VirtPort == 0 {
+		return errors.New("Forward must have an onion port")
+	}
+	if path, ok := strings.CutPrefix(f.Target, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("Invalid unix socket of forward: %q", f.Target)
+		}
+		return nil
+	}
+	port := f.Target
+	if strings.Contains(f.Target, ":") {
+		var err error
+		if _, port, err = net.SplitHostPort(f.Target); err != nil {
+			return fmt.Errorf("Invalid target of forward: %v", err)
+		}
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("Invalid target of forward: %q", f.Target)
+	}
+	return nil
+}
+
+// forward publishes an onion service forwarding p.Forwards, sends
+// its link to linkChan and keeps it up until ctx is done, TTL is
+// over or connection to tor is lost. Nothing is served by onionize
+// itself, so HTTP options of p have no effect.
+func forward(ctx context.Context, p Parameters, linkChan chan<- ResultLink) error {
+	if p.NoOnion || p.Listener != nil {
+		return errors.New("Forwarding requires onion services")
+	}
+	if p.SeparateOnions {
+		return errors.New("Forwards can't be shared via separate onions")
+	}
+	ports := make([]bulb.OnionPortSpec, 0, len(p.Forwards))
+	for _, f := range p.Forwards {
+		if err := f.validate(); err != nil {
+			return err
+		}
+		ports = append(ports, bulb.OnionPortSpec{VirtPort: f.VirtPort, Target: f.Target})
+	}
+	o, err := publishOnion(p, ports)
+	if err != nil {
+		return err
+	}
+	lost := make(chan error, 1)
+	go o.watch(nil, func(err error) {
+		if o.reconnects() {
+			logger(p).Warn("Lost connection to tor, reconnecting", "err", err)
+			return
+		}
+		lost <- err
+	}, nil)
+	select {
+	case linkChan <- ResultLink{URL: url.URL{Host: o.ID + ".onion"}, Key: o.Key, ClientAuth: o.ClientAuth}:
+	case <-ctx.Done():
+		o.close()
+		return ctx.Err()
+	}
+	var expired <-chan time.Time
+	if p.TTL > 0 {
+		t := time.NewTimer(p.TTL)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-ctx.Done():
+	case <-expired:
+	case <-lost:
+	}
+	if err := o.close(); err != nil {
+		return fmt.Errorf("Lost connection to tor: %v", err)
+	}
+	return nil
+}
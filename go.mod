@@ -1,19 +1,27 @@
 module github.com/nogoegst/onionize
 
+go 1.24.0
+
 require (
+	filippo.io/edwards25519 v1.2.0
 	github.com/gotk3/gotk3 v0.0.0-20180905040958-020531a77b59
-	github.com/matryer/is v1.2.0 // indirect
 	github.com/nogoegst/balloon v1.0.0
-	github.com/nogoegst/blake2xb v1.0.1 // indirect
 	github.com/nogoegst/bulb v1.1.0
-	github.com/nogoegst/fileserver v1.0.0
 	github.com/nogoegst/onionutil v1.1.0
-	github.com/nogoegst/pickfs v1.1.0 // indirect
 	github.com/nogoegst/terminal v0.0.0-20161218222815-90cba33d8a32
 	github.com/nogoegst/textqr v0.0.0-20181213220145-28c55cae7e92
 	github.com/nogoegst/tlspin v2.1.0+incompatible
+	github.com/ulikunitz/xz v0.5.17
 	golang.org/x/crypto v0.0.0-20181106171534-e4dc69e5b2fd
-	golang.org/x/sys v0.0.0-20180909124046-d0be0721c37e // indirect
-	golang.org/x/tools v0.0.0-20180910180008-18207bb12d3a // indirect
 	rsc.io/qr v0.2.0
 )
+
+require (
+	github.com/matryer/is v1.2.0 // indirect
+	github.com/nogoegst/blake2xb v1.0.1 // indirect
+	github.com/nogoegst/pickfs v1.1.0
+	github.com/nogoegst/wslpath v0.1.0 // indirect
+	golang.org/x/net v0.0.0-20181107093936-a544f70c90f1
+	golang.org/x/sys v0.0.0-20180909124046-d0be0721c37e // indirect
+	golang.org/x/tools v0.0.0-20180910180008-18207bb12d3a
+)
@@ -0,0 +1,62 @@
+// headfirst.go - require HEAD before GET for file downloads.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// headFirstWindow is the time a HEAD request permits GETs of the path.
+const headFirstWindow = time.Minute
+
+// headTracker remembers recent HEAD requests by path. There is no
+// client identity over tor, so a HEAD by anyone permits GETs by everyone.
+type headTracker struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func newHeadTracker() *headTracker {
+	return &headTracker{seen: make(map[string]time.Time)}
+}
+
+func (t *headTracker) head(p string) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for sp, at := range t.seen {
+		if now.Sub(at) > headFirstWindow {
+			delete(t.seen, sp)
+		}
+	}
+	t.seen[p] = now
+}
+
+func (t *headTracker) recent(p string) bool {
+	t.Lock()
+	defer t.Unlock()
+	at, ok := t.seen[p]
+	return ok && time.Since(at) <= headFirstWindow
+}
+
+// check records HEAD requests for file name and reports
+// whether the request may proceed. It responds with 428 otherwise.
+func (t *headTracker) check(w http.ResponseWriter, req *http.Request, name string) bool {
+	switch req.Method {
+	case http.MethodHead:
+		t.head(name)
+	case http.MethodGet:
+		if !t.recent(name) {
+			http.Error(w, "Send HEAD request first", http.StatusPreconditionRequired)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package onionize
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequireHeadFirst(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "share")
+	writeFile(t, filepath.Join(dir, "a.txt"), "a")
+	writeFile(t, filepath.Join(dir, "b.txt"), "b")
+	fs := newTestFileServer(t, Parameters{Paths: []string{dir}, RequireHeadFirst: true})
+	head := func(target string) int {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest("HEAD", target, nil))
+		return w.Code
+	}
+
+	if w := get(fs, "/share/a.txt"); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("bare GET: %d", w.Code)
+	}
+	if code := head("/share/a.txt"); code != http.StatusOK {
+		t.Fatalf("HEAD: %d", code)
+	}
+	if w := get(fs, "/share/a.txt"); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Fatalf("GET after HEAD: %d %q", w.Code, w.Body.String())
+	}
+	if w := get(fs, "/share/b.txt"); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("GET of another file after HEAD: %d", w.Code)
+	}
+	if w := get(fs, "/share/"); w.Code != http.StatusOK {
+		t.Fatalf("listing without HEAD: %d", w.Code)
+	}
+
+	fs.heads.Lock()
+	fs.heads.seen["/share/a.txt"] = time.Now().Add(-headFirstWindow - time.Second)
+	fs.heads.Unlock()
+	if w := get(fs, "/share/a.txt"); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("GET long after HEAD: %d", w.Code)
+	}
+}
@@ -0,0 +1,31 @@
+// edkey.go - public keys of expanded ed25519 secret keys.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+// Package edkey derives public keys of expanded ed25519 secret keys
+// (clamped scalar followed by the hash prefix), which is the only
+// form tor gives ed25519 onion keys in.
+package edkey
+
+import (
+	"errors"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// PublicKey returns ed25519 public key of expanded secret key.
+// It runs in constant time.
+func PublicKey(expanded []byte) (ed25519.PublicKey, error) {
+	if len(expanded) != 64 {
+		return nil, errors.New("Invalid length of expanded ed25519 key")
+	}
+	s, err := new(edwards25519.Scalar).SetBytesWithClamping(expanded[:32])
+	if err != nil {
+		return nil, err
+	}
+	return new(edwards25519.Point).ScalarBaseMult(s).Bytes(), nil
+}
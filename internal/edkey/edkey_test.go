@@ -0,0 +1,30 @@
+package edkey
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestPublicKey(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		seed := bytes.Repeat([]byte{byte(i * 37)}, ed25519.SeedSize)
+		h := sha512.Sum512(seed)
+		h[0] &= 248
+		h[31] &= 127
+		h[31] |= 64
+		pk, err := PublicKey(h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+		if !bytes.Equal(pk, want) {
+			t.Fatalf("public key of seed %d is %x, want %x", i, pk, want)
+		}
+	}
+	if _, err := PublicKey(make([]byte, 32)); err == nil {
+		t.Fatal("short key is accepted")
+	}
+}
@@ -0,0 +1,91 @@
+// iofs.go - adapt io/fs filesystems to vfs.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// iofs implements vfs.FileSystem on top of fs.FS.
+type iofs struct {
+	fsys fs.FS
+}
+
+func newIOFS(fsys fs.FS) vfs.FileSystem {
+	return iofs{fsys}
+}
+
+func (f iofs) String() string { return "iofs" }
+
+func (f iofs) RootType(string) vfs.RootType {
+	return ""
+}
+
+// name converts slash-rooted vfs path p to fs.FS name.
+func (f iofs) name(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Open opens file p. Files that are not seekable (e.g. ones from
+// zip.Reader) are read into memory.
+func (f iofs) Open(p string) (vfs.ReadSeekCloser, error) {
+	file, err := f.fsys.Open(f.name(p))
+	if err != nil {
+		return nil, err
+	}
+	if rsc, ok := file.(vfs.ReadSeekCloser); ok {
+		return rsc, nil
+	}
+	defer file.Close()
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+func (f iofs) Lstat(p string) (os.FileInfo, error) {
+	return f.Stat(p)
+}
+
+func (f iofs) Stat(p string) (os.FileInfo, error) {
+	return fs.Stat(f.fsys, f.name(p))
+}
+
+func (f iofs) ReadDir(p string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(f.fsys, f.name(p))
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
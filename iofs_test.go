@@ -0,0 +1,90 @@
+package onionize
+
+import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+//go:embed testdata/iofs
+var embeddedFS embed.FS
+
+var iofsFiles = map[string]string{
+	"hello.txt":      "hello, world\n",
+	"sub/nested.txt": "nested\n",
+}
+
+func zipFS(t *testing.T) fs.FS {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range iofsFiles {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func TestIOFS(t *testing.T) {
+	embedded, err := fs.Sub(embeddedFS, "testdata/iofs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapFS := fstest.MapFS{}
+	for name, content := range iofsFiles {
+		mapFS[name] = &fstest.MapFile{Data: []byte(content), Mode: 0644}
+	}
+	for _, src := range []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"DirFS", os.DirFS("testdata/iofs")},
+		{"MapFS", mapFS},
+		{"embed", embedded},
+		{"zip", zipFS(t)},
+	} {
+		t.Run(src.name, func(t *testing.T) {
+			if err := fstest.TestFS(src.fsys, "hello.txt", "sub/nested.txt"); err != nil {
+				t.Fatal(err)
+			}
+			fs := newTestFileServer(t, Parameters{FS: src.fsys})
+			w := get(fs, "/")
+			for _, link := range []string{`href="./hello.txt"`, `href="./sub/"`} {
+				if !strings.Contains(w.Body.String(), link) {
+					t.Errorf("root listing has no %s: %q", link, w.Body.String())
+				}
+			}
+			for name, content := range iofsFiles {
+				if w := get(fs, "/"+name); w.Code != http.StatusOK || w.Body.String() != content {
+					t.Errorf("%s: got %d %q, want %q", name, w.Code, w.Body.String(), content)
+				}
+			}
+			req := httptest.NewRequest("GET", "/hello.txt", nil)
+			req.Header.Set("Range", "bytes=7-")
+			w = httptest.NewRecorder()
+			fs.ServeHTTP(w, req)
+			if w.Code != http.StatusPartialContent || w.Body.String() != "world\n" {
+				t.Errorf("range: got %d %q", w.Code, w.Body.String())
+			}
+			if w := get(fs, "/missing"); w.Code != http.StatusNotFound {
+				t.Errorf("missing file: %d", w.Code)
+			}
+		})
+	}
+}
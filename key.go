@@ -0,0 +1,288 @@
+// key.go - onion key formats.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"bytes"
+	"crypto"
+	stded25519 "crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+
+	"github.com/nogoegst/bulb"
+	"github.com/nogoegst/onionize/internal/edkey"
+	"github.com/nogoegst/onionutil"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Formats of exported onion keys.
+const (
+	// KeyFormatTor is the format tor keeps keys in HiddenServiceDir:
+	// hs_ed25519_secret_key for v3 keys and PKCS#1 PEM (private_key)
+	// for v2 keys.
+	KeyFormatTor = "tor"
+	// KeyFormatPEM is PKCS#8 PEM for v3 keys and PKCS#1 PEM
+	// for v2 keys.
+	KeyFormatPEM = "pem"
+)
+
+// Types of onion keys.
+const (
+	// KeyTypeED25519V3 is the key type of v3 onion services (default).
+	KeyTypeED25519V3 = "ed25519-v3"
+	// KeyTypeRSA1024 is the key type of deprecated v2 onion services.
+	KeyTypeRSA1024 = "rsa1024"
+)
+
+// checkKeySources makes sure p has one source of the onion key and
+// one destination to export it to at most, so none of them is
+// silently ignored.
+func checkKeySources(p Parameters) error {
+	sources := 0
+	for _, set := range []bool{p.Passphrase != "", p.KeyIn != "", p.IdentityPath != "", p.IdentityKey != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("Only one of Passphrase, KeyIn, IdentityPath and IdentityKey can be set")
+	}
+	if p.ExportKeyPath != "" && p.KeyOut != nil {
+		return errors.New("Only one of ExportKeyPath and KeyOut can be set")
+	}
+	return nil
+}
+
+// onionVersion returns onion service version of keys of keyType
+// as accepted by onionutil.GenerateOnionKey.
+func onionVersion(keyType string) (string, error) {
+	switch keyType {
+	case "", KeyTypeED25519V3:
+		return "3", nil
+	case KeyTypeRSA1024:
+		return "2", nil
+	default:
+		return "", fmt.Errorf("Unknown onion key type %q", keyType)
+	}
+}
+
+const (
+	torKeyTypeED25519V3 = "ED25519-V3"
+	torSecretKeyMagic   = "== ed25519v1-secret: type0 =="
+	torKeyHeaderSize    = 32
+)
+
+// expandED25519 returns expanded ed25519 secret key (clamped scalar
+// followed by hash prefix) as used by tor.
+func expandED25519(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key[:ed25519.SeedSize])
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:]
+}
+
+// expandedKey returns expanded ed25519 secret key from key.
+func expandedKey(key crypto.PrivateKey) ([]byte, bool) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return expandED25519(k), true
+	case *bulb.OnionPrivateKey:
+		if k.KeyType != torKeyTypeED25519V3 {
+			return nil, false
+		}
+		b, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil || len(b) != 64 {
+			return nil, false
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+// onionAddress returns onion address of key, including keys only
+// known to tor (as *bulb.OnionPrivateKey).
+func onionAddress(key crypto.PrivateKey) (string, error) {
+	k, ok := key.(*bulb.OnionPrivateKey)
+	if !ok {
+		return onionutil.OnionAddress(key)
+	}
+	b, err := base64.StdEncoding.DecodeString(k.Key)
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode %s key: %v", k.KeyType, err)
+	}
+	switch k.KeyType {
+	case torKeyTypeED25519V3:
+		pk, err := edkey.PublicKey(b)
+		if err != nil {
+			return "", err
+		}
+		return onionutil.OnionAddressV3(pk)
+	case "RSA1024":
+		rk, err := x509.ParsePKCS1PrivateKey(b)
+		if err != nil {
+			return "", err
+		}
+		return onionutil.OnionAddressV2(&rk.PublicKey)
+	default:
+		return "", fmt.Errorf("Unsupported type of onion key: %s", k.KeyType)
+	}
+}
+
+// bulbKey converts key to a type accepted by bulb.
+func bulbKey(key crypto.PrivateKey) crypto.PrivateKey {
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return &bulb.OnionPrivateKey{
+			KeyType: torKeyTypeED25519V3,
+			Key:     base64.StdEncoding.EncodeToString(expandED25519(k)),
+		}
+	}
+	return key
+}
+
+// ExportKey serializes onion private key in format
+// (KeyFormatTor or KeyFormatPEM).
+func ExportKey(key crypto.PrivateKey, format string) ([]byte, error) {
+	if k, ok := key.(*rsa.PrivateKey); ok {
+		switch format {
+		case KeyFormatTor, KeyFormatPEM:
+			return pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(k),
+			}), nil
+		default:
+			return nil, fmt.Errorf("Unknown key format %q", format)
+		}
+	}
+	switch format {
+	case KeyFormatTor:
+		expanded, ok := expandedKey(key)
+		if !ok {
+			return nil, errors.New("Unsupported type of onion key")
+		}
+		var b bytes.Buffer
+		b.WriteString(torSecretKeyMagic)
+		b.Write(make([]byte, torKeyHeaderSize-len(torSecretKeyMagic)))
+		b.Write(expanded)
+		return b.Bytes(), nil
+	case KeyFormatPEM:
+		k, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("Only keys with a seed can be exported to PEM")
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(stded25519.PrivateKey(k))
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, fmt.Errorf("Unknown key format %q", format)
+	}
+}
+
+// ParseKey parses onion private key exported by ExportKey
+// in any format.
+func ParseKey(b []byte) (crypto.PrivateKey, error) {
+	if len(b) == torKeyHeaderSize+64 && bytes.HasPrefix(b, []byte(torSecretKeyMagic)) {
+		return &bulb.OnionPrivateKey{
+			KeyType: torKeyTypeED25519V3,
+			Key:     base64.StdEncoding.EncodeToString(b[torKeyHeaderSize:]),
+		}, nil
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("Unrecognized format of onion key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case stded25519.PrivateKey:
+			return ed25519.PrivateKey(k), nil
+		case *rsa.PrivateKey:
+			return k, nil
+		}
+		return nil, errors.New("Unsupported type of onion key")
+	default:
+		return nil, fmt.Errorf("Unrecognized type of PEM block %q", block.Type)
+	}
+}
+
+// keyFormat returns the format to export key in: PEM unless key
+// is only known to tor.
+func keyFormat(key crypto.PrivateKey) string {
+	if _, ok := key.(*bulb.OnionPrivateKey); ok {
+		return KeyFormatTor
+	}
+	return KeyFormatPEM
+}
+
+// writeKeyFile exports key in format to file at path
+// readable by owner only.
+func writeKeyFile(path string, key crypto.PrivateKey, format string) error {
+	return saveKey(path, key, format, os.O_TRUNC)
+}
+
+// createKeyFile is like writeKeyFile, but fails if the file exists.
+func createKeyFile(path string, key crypto.PrivateKey, format string) error {
+	return saveKey(path, key, format, os.O_EXCL)
+}
+
+func saveKey(path string, key crypto.PrivateKey, format string, flag int) error {
+	b, err := ExportKey(key, format)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadIdentity reads onion key from file at path. The key is nil
+// if there is no such file yet.
+func loadIdentity(path string, log *slog.Logger) (crypto.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read onion key: %v", err)
+	}
+	// Windows has no permission bits to check
+	if fi, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		log.Warn("Onion key file is accessible by other users", "path", path)
+	}
+	key, err := ParseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse onion key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,43 @@
+package onionize
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckKeySources(t *testing.T) {
+	for name, p := range map[string]Parameters{
+		"passphrase and identity": {Passphrase: "x", IdentityPath: "id.key"},
+		"key and identity":        {KeyIn: "in.key", IdentityPath: "id.key"},
+		"key and identity key":    {KeyIn: "in.key", IdentityKey: struct{}{}},
+		"exports":                 {ExportKeyPath: "out.key", KeyOut: new(bytes.Buffer)},
+	} {
+		if err := checkKeySources(p); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	for name, p := range map[string]Parameters{
+		"none":               {},
+		"passphrase":         {Passphrase: "x", ExportKeyPath: "out.key"},
+		"identity":           {IdentityPath: "id.key", KeyOut: new(bytes.Buffer)},
+		"identity key":       {IdentityKey: struct{}{}},
+		"key in and key out": {KeyIn: "in.key", KeyOut: new(bytes.Buffer)},
+	} {
+		if err := checkKeySources(p); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	ft := newFake(t)
+	for name, p := range map[string]Parameters{
+		"identity":              {Passphrase: "x", IdentityPath: "id.key"},
+		"slug and identity":     {Passphrase: "x", PassphraseSlug: true, Slug: true, IdentityPath: "id.key"},
+		"slug and identity key": {Passphrase: "x", PassphraseSlug: true, Slug: true, IdentityKey: struct{}{}},
+	} {
+		p.Text = "hi"
+		p.DialControl = ft.Dial
+		if s, err := CreateOnion(p); err == nil {
+			s.Close()
+			t.Errorf("%s: share with two keys is created", name)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// listing.go - render directory listings and landing pages.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultTemplates are templates of directory listings ("listing"),
+// of the landing page of single file shares ("landing") and of
+// shared text ("text").
+var defaultTemplates = template.Must(template.New("").Parse(`
+{{define "head"}}<!doctype html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: .3em .5em; border-bottom: 1px solid #ddd; }
+td.size { text-align: right; white-space: nowrap; color: #666; }
+pre { white-space: pre-wrap; word-wrap: break-word; background: #f6f6f6; padding: 1em; }
+blockquote { border-left: .3em solid #ddd; margin-left: 0; padding-left: 1em; color: #555; }
+a.button, button { display: inline-block; padding: 1em 2em; margin: 1em 0; background: #7d4698; color: #fff; text-decoration: none; border-radius: .3em; font-size: 1.2em; }
+</style>
+{{end}}
+{{define "listing"}}{{template "head"}}<title>{{.Path}}</title>
+<h1>{{.Path}}</h1>
+{{if .ZipURL}}<p><a href="{{.ZipURL}}">Download all as zip</a></p>{{end}}
+<table>
+{{if .ParentURL}}<tr><td><a href="{{.ParentURL}}">../</a></td><td></td></tr>{{end}}
+{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td class="size">{{if not .Dir}}{{.HumanSize}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{define "landing"}}{{template "head"}}<title>{{.Name}}</title>
+<h1>{{.Name}}</h1>
+<p>{{.HumanSize}}</p>
+<a class="button" href="{{.URL}}" download>Download</a>
+{{end}}
+{{define "text"}}{{template "head"}}<title>{{.Title}}</title>
+<textarea id="text" hidden>{{.Text}}</textarea>
+<button onclick="navigator.clipboard.writeText(document.getElementById('text').value).then(() => { this.textContent = 'Copied' })">Copy</button>
+<a href="?raw">Raw</a>
+{{if .HTML}}<article>{{.HTML}}</article>{{else}}<pre>{{.Text}}</pre>{{end}}
+{{end}}
+`))
+
+// ListingEntry is a file or a directory in a listing.
+type ListingEntry struct {
+	Name string
+	// URL is relative to the listing
+	URL  string
+	Dir  bool
+	Size int64
+}
+
+// HumanSize returns size of the entry in human-readable form.
+func (e ListingEntry) HumanSize() string {
+	return humanSize(e.Size)
+}
+
+// Listing is the data listing templates are executed with.
+type Listing struct {
+	Path string
+	// ParentURL is empty at the root
+	ParentURL string
+	// ZipURL is set if the directory can be downloaded as zip
+	// (see Parameters.ZipDownloads)
+	ZipURL  string
+	Entries []ListingEntry
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// lookupTemplate returns template name of ts or the default one.
+func lookupTemplate(ts *template.Template, name string) *template.Template {
+	if ts != nil {
+		if t := ts.Lookup(name); t != nil {
+			return t
+		}
+	}
+	return defaultTemplates.Lookup(name)
+}
+
+// template returns template name of fs.templates or the default one.
+func (fs *fileServer) template(name string) *template.Template {
+	return lookupTemplate(fs.templates, name)
+}
+
+// renderListing renders listing of directory name.
+func (fs *fileServer) renderListing(name string) ([]byte, error) {
+	fis, err := fs.fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	l := Listing{Path: name}
+	if name != "/" {
+		l.ParentURL = "../"
+	}
+	if fs.zipDownloads {
+		l.ZipURL = "?download=zip"
+	}
+	for _, fi := range fis {
+		// pickfs lists aliases as fake entries
+		if sfi, err := fs.fs.Stat(path.Join(name, fi.Name())); err == nil {
+			fi = sfi
+		}
+		u := escapePath(fi.Name())
+		if fi.IsDir() {
+			u += "/"
+		}
+		l.Entries = append(l.Entries, ListingEntry{
+			Name: fi.Name(),
+			URL:  "./" + u,
+			Dir:  fi.IsDir(),
+			Size: fi.Size(),
+		})
+	}
+	var b bytes.Buffer
+	if err := fs.template("listing").Execute(&b, l); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+type listing struct {
+	body []byte
+	etag string
+	// state of the directory the listing was rendered at
+	state string
+}
+
+func (fs *fileServer) newListing(name string) (*listing, error) {
+	body, err := fs.renderListing(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	return &listing{
+		body: body,
+		etag: `"` + hex.EncodeToString(sum[:16]) + `"`,
+	}, nil
+}
+
+// dirState returns digest of names, sizes, modes and modification
+// times of entries of directory name. It changes once an entry is
+// added, removed or renamed even if modification times are masked.
+func (fs *fileServer) dirState(name string) (string, error) {
+	fis, err := fs.fs.ReadDir(name)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, fi := range fis {
+		fmt.Fprintf(h, "%q %d %v %d\n", fi.Name(), fi.Size(), fi.Mode(), fi.ModTime().UnixNano())
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// listingCache holds rendered directory listings. A listing is
+// rendered again once entries of its directory change.
+type listingCache struct {
+	sync.Mutex
+	m map[string]*listing
+}
+
+func newListingCache() *listingCache {
+	return &listingCache{m: make(map[string]*listing)}
+}
+
+func (lc *listingCache) get(fs *fileServer, name string) (*listing, error) {
+	state, err := fs.dirState(name)
+	if err != nil {
+		return nil, err
+	}
+	lc.Lock()
+	l, ok := lc.m[name]
+	lc.Unlock()
+	if ok && l.state == state {
+		return l, nil
+	}
+	// Render without holding up other listings
+	l, err = fs.newListing(name)
+	if err != nil {
+		return nil, err
+	}
+	l.state = state
+	lc.Lock()
+	lc.m[name] = l
+	lc.Unlock()
+	return l, nil
+}
+
+func (fs *fileServer) serveListing(w http.ResponseWriter, req *http.Request, name string) {
+	var l *listing
+	var err error
+	if fs.listings != nil {
+		l, err = fs.listings.get(fs, name)
+	} else {
+		l, err = fs.newListing(name)
+	}
+	if err != nil {
+		fs.log.Error("Unable to render listing", "path", name, "err", err)
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", l.etag)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(l.body))
+}
+
+// serveLanding serves the landing page of file at name.
+func (fs *fileServer) serveLanding(w http.ResponseWriter, req *http.Request, name string, fi os.FileInfo) {
+	var b bytes.Buffer
+	err := fs.template("landing").Execute(&b, ListingEntry{
+		Name: fi.Name(),
+		URL:  escapePath(name),
+		Size: fi.Size(),
+	})
+	if err != nil {
+		fs.log.Error("Unable to render landing page", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,74 @@
+package onionize
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListingCacheInvalidation(t *testing.T) {
+	for _, mask := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mask=%v", mask), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "share")
+			writeFile(t, filepath.Join(dir, "old.txt"), "old")
+			fs := newTestFileServer(t, Parameters{Paths: []string{dir}, CacheListings: true, MaskModTimes: mask})
+			now := time.Now()
+			fs.fs.(*metaCache).now = func() time.Time { return now }
+
+			w := get(fs, "/share/")
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "old.txt") {
+				t.Fatalf("listing: %d %q", w.Code, w.Body.String())
+			}
+			etag := w.Header().Get("ETag")
+
+			// Modification time of the directory may stay the same
+			mtime := time.Unix(0, 0)
+			for _, change := range []func(){
+				func() { writeFile(t, filepath.Join(dir, "new.txt"), "new") },
+				func() { os.Rename(filepath.Join(dir, "new.txt"), filepath.Join(dir, "renamed.txt")) },
+				func() { writeFile(t, filepath.Join(dir, "renamed.txt"), "resized") },
+			} {
+				change()
+				if err := os.Chtimes(dir, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				now = now.Add(metaCacheTTL)
+				w = get(fs, "/share/")
+				if w.Header().Get("ETag") == etag {
+					t.Fatal("listing is not rendered again after directory change")
+				}
+				etag = w.Header().Get("ETag")
+			}
+			if !strings.Contains(w.Body.String(), "renamed.txt") || strings.Contains(w.Body.String(), "new.txt") {
+				t.Fatalf("stale listing: %q", w.Body.String())
+			}
+			if w := get(fs, "/share/"); w.Header().Get("ETag") != etag {
+				t.Fatal("listing of unchanged directory is rendered again")
+			}
+		})
+	}
+}
+
+func TestListingCacheConcurrent(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"a", "b", "c", "d"} {
+		writeFile(t, filepath.Join(root, "share", d, "file"), d)
+	}
+	fs := newTestFileServer(t, Parameters{Paths: []string{filepath.Join(root, "share")}, CacheListings: true})
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(d string) {
+			defer wg.Done()
+			if w := get(fs, "/share/"+d+"/"); w.Code != http.StatusOK {
+				t.Errorf("listing of %s: %d", d, w.Code)
+			}
+		}(string(rune('a' + i%4)))
+	}
+	wg.Wait()
+}
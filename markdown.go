@@ -0,0 +1,165 @@
+// markdown.go - render a subset of markdown.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdNumber  = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong  = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEm      = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// renderMarkdown renders headings, paragraphs, lists, quotes, code
+// blocks (tagged with "language-" class, not highlighted), code
+// spans, emphasis and links of md. Raw HTML is escaped and links
+// other than http(s), mailto and relative ones are dropped.
+func renderMarkdown(md string) template.HTML {
+	var b bytes.Buffer
+	var para []string
+	list := ""
+	flushPara := func() {
+		if len(para) != 0 {
+			fmt.Fprintf(&b, "<p>%s</p>\n", mdInline(strings.Join(para, " ")))
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			fmt.Fprintf(&b, "</%s>\n", list)
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			fmt.Fprintf(&b, "<%s>\n", tag)
+			list = tag
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if fence, ok := strings.CutPrefix(strings.TrimSpace(line), "```"); ok {
+			flushPara()
+			closeList()
+			lang := strings.TrimSpace(fence)
+			if lang != "" {
+				fmt.Fprintf(&b, `<pre><code class="language-%s">`, html.EscapeString(lang))
+			} else {
+				b.WriteString("<pre><code>")
+			}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				b.WriteString(html.EscapeString(lines[i]) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			flushPara()
+			closeList()
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			flushPara()
+			closeList()
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", len(m[1]), mdInline(m[2]), len(m[1]))
+			continue
+		}
+		if m := mdBullet.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ul")
+			fmt.Fprintf(&b, "<li>%s</li>\n", mdInline(m[1]))
+			continue
+		}
+		if m := mdNumber.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ol")
+			fmt.Fprintf(&b, "<li>%s</li>\n", mdInline(m[1]))
+			continue
+		}
+		if quote, ok := strings.CutPrefix(line, ">"); ok {
+			flushPara()
+			closeList()
+			fmt.Fprintf(&b, "<blockquote>%s</blockquote>\n", mdInline(strings.TrimSpace(quote)))
+			continue
+		}
+		closeList()
+		para = append(para, strings.TrimSpace(line))
+	}
+	flushPara()
+	closeList()
+	return template.HTML(b.String())
+}
+
+// mdInline renders inline markup of s. Code spans are left as is.
+func mdInline(s string) string {
+	parts := strings.Split(s, "`")
+	for i, part := range parts {
+		// Odd parts are inside of code spans unless unpaired
+		if i%2 == 1 && i != len(parts)-1 {
+			parts[i] = "<code>" + html.EscapeString(part) + "</code>"
+			continue
+		}
+		part = mdLinks(html.EscapeString(part))
+		if i%2 == 1 {
+			part = "`" + part
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "")
+}
+
+// mdLinks renders links and emphasis of escaped s. Emphasis is
+// rendered in text of links but not in their targets.
+func mdLinks(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mdLink.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(mdEmphasis(s[last:m[0]]))
+		text, link := s[m[2]:m[3]], s[m[4]:m[5]]
+		if safeLink(html.UnescapeString(link)) {
+			fmt.Fprintf(&b, `<a href="%s">%s</a>`, link, mdEmphasis(text))
+		} else {
+			b.WriteString(mdEmphasis(text))
+		}
+		last = m[1]
+	}
+	b.WriteString(mdEmphasis(s[last:]))
+	return b.String()
+}
+
+// mdEmphasis renders strong and emphasized text of escaped s.
+func mdEmphasis(s string) string {
+	s = mdStrong.ReplaceAllString(s, "<strong>$1$2</strong>")
+	return mdEm.ReplaceAllString(s, "<em>$1$2</em>")
+}
+
+// safeLink reports whether link is relative or has http(s) or
+// mailto scheme.
+func safeLink(link string) bool {
+	scheme, _, ok := strings.Cut(link, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
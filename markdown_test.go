@@ -0,0 +1,36 @@
+package onionize
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdownInline(t *testing.T) {
+	for md, want := range map[string]string{
+		"*em* and **strong**":                      "<em>em</em> and <strong>strong</strong>",
+		"[a _b_ link](https://x.onion/a_foo_b)":    `<a href="https://x.onion/a_foo_b">a <em>b</em> link</a>`,
+		"see [it](http://x.onion/*a*/**b**) *now*": `see <a href="http://x.onion/*a*/**b**">it</a> <em>now</em>`,
+		"_x_ [y](/__init__.py) _z_":                `<em>x</em> <a href="/__init__.py">y</a> <em>z</em>`,
+		"[bad](javascript:void) _ok_":              "bad <em>ok</em>",
+		"`*code*` *text*":                          "<code>*code*</code> <em>text</em>",
+		"<b>raw</b>":                               "&lt;b&gt;raw&lt;/b&gt;",
+	} {
+		if got := mdInline(md); got != want {
+			t.Errorf("%q is rendered as %q, want %q", md, got, want)
+		}
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	got := string(renderMarkdown("# Title\n\n- [one](https://x.onion/_1_)\n- *two*\n\ntext"))
+	for _, want := range []string{
+		"<h1>Title</h1>",
+		`<li><a href="https://x.onion/_1_">one</a></li>`,
+		"<li><em>two</em></li>",
+		"<p>text</p>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q is not in %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// metacache.go - cache file metadata of static shares.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+const (
+	// maxMetaCacheEntries bounds the number of results kept.
+	maxMetaCacheEntries = 4096
+	// metaCacheTTL is how long results are kept for.
+	metaCacheTTL = 5 * time.Second
+	// copyBufSize is the size of buffers of copyBufs.
+	copyBufSize = 32 << 10
+)
+
+// copyBufs keeps buffers for reading files whole, i.e. into digests
+// and zip archives, so that a buffer isn't allocated per file on
+// directories with many small files. Files served as they are don't
+// need it: net/http pools buffers of its own.
+var copyBufs = sync.Pool{New: func() any {
+	b := make([]byte, copyBufSize)
+	return &b
+}}
+
+// copyFile copies f to w with a buffer of copyBufs.
+func copyFile(w io.Writer, f io.Reader) (int64, error) {
+	buf := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(buf)
+	// Hide WriteTo of os.File, which allocates a buffer of its own
+	// for writers other than sockets
+	return io.CopyBuffer(w, struct{ io.Reader }{f}, *buf)
+}
+
+type metaEntry struct {
+	key   string
+	fi    os.FileInfo
+	fis   []os.FileInfo
+	added time.Time
+}
+
+// metaCache caches results of Stat, Lstat and ReadDir of vfs.FileSystem.
+// Every request for a directory stats it and its index.html a few
+// times, so it saves a lot of syscalls on directories with many
+// small files. Only successful results are cached, for metaCacheTTL
+// so changes are picked up, and the least recently used ones are
+// dropped once there are maxMetaCacheEntries of them.
+type metaCache struct {
+	vfs.FileSystem
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	max     int
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func newMetaCache(fs vfs.FileSystem) *metaCache {
+	return &metaCache{
+		FileSystem: fs,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		max:        maxMetaCacheEntries,
+		ttl:        metaCacheTTL,
+		now:        time.Now,
+	}
+}
+
+func (mc *metaCache) get(key string) (*metaEntry, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	el, ok := mc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*metaEntry)
+	if mc.now().Sub(e.added) >= mc.ttl {
+		mc.lru.Remove(el)
+		delete(mc.entries, key)
+		return nil, false
+	}
+	mc.lru.MoveToFront(el)
+	return e, true
+}
+
+func (mc *metaCache) put(e *metaEntry) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	e.added = mc.now()
+	if el, ok := mc.entries[e.key]; ok {
+		el.Value = e
+		mc.lru.MoveToFront(el)
+		return
+	}
+	mc.entries[e.key] = mc.lru.PushFront(e)
+	for mc.lru.Len() > mc.max {
+		el := mc.lru.Back()
+		mc.lru.Remove(el)
+		delete(mc.entries, el.Value.(*metaEntry).key)
+	}
+}
+
+func (mc *metaCache) stat(key string, stat func(string) (os.FileInfo, error), p string) (os.FileInfo, error) {
+	if e, ok := mc.get(key); ok {
+		return e.fi, nil
+	}
+	fi, err := stat(p)
+	if err != nil {
+		return nil, err
+	}
+	mc.put(&metaEntry{key: key, fi: fi})
+	return fi, nil
+}
+
+func (mc *metaCache) Stat(p string) (os.FileInfo, error) {
+	return mc.stat("stat:"+p, mc.FileSystem.Stat, p)
+}
+
+func (mc *metaCache) Lstat(p string) (os.FileInfo, error) {
+	return mc.stat("lstat:"+p, mc.FileSystem.Lstat, p)
+}
+
+func (mc *metaCache) ReadDir(p string) ([]os.FileInfo, error) {
+	key := "readdir:" + p
+	e, ok := mc.get(key)
+	if !ok {
+		fis, err := mc.FileSystem.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		e = &metaEntry{key: key, fis: fis}
+		mc.put(e)
+	}
+	// Callers are free to sort the result
+	fis := make([]os.FileInfo, len(e.fis))
+	copy(fis, e.fis)
+	return fis, nil
+}
@@ -0,0 +1,109 @@
+package onionize
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+func TestMetaCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a"), "a")
+	mc := newMetaCache(vfs.OS(dir))
+	now := time.Now()
+	mc.now = func() time.Time { return now }
+
+	if _, err := mc.Stat("/missing"); err == nil {
+		t.Fatal("missing file is there")
+	}
+	writeFile(t, filepath.Join(dir, "missing"), "here")
+	if _, err := mc.Stat("/missing"); err != nil {
+		t.Fatalf("error is cached: %v", err)
+	}
+
+	if _, err := mc.Stat("/a"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "a"))
+	if _, err := mc.Stat("/a"); err != nil {
+		t.Fatal("stat is not cached")
+	}
+	now = now.Add(metaCacheTTL)
+	if _, err := mc.Stat("/a"); err == nil {
+		t.Fatal("stat is cached after TTL")
+	}
+
+	mc.max = 10
+	for i := 0; i < 100; i++ {
+		mc.Stat(fmt.Sprintf("/missing-%d", i))
+		mc.Stat("/missing")
+	}
+	if mc.lru.Len() > mc.max || len(mc.entries) != mc.lru.Len() {
+		t.Fatalf("%d entries (%d in list) kept, want up to %d", len(mc.entries), mc.lru.Len(), mc.max)
+	}
+	// The recently used one is kept
+	if _, ok := mc.get("stat:/missing"); !ok {
+		t.Fatal("recently used entry is dropped")
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	want := strings.Repeat("onionize", copyBufSize/4)
+	for i := 0; i < 2; i++ {
+		var b strings.Builder
+		if n, err := copyFile(&b, strings.NewReader(want)); err != nil || n != int64(len(want)) {
+			t.Fatalf("copied %d bytes: %v", n, err)
+		}
+		if b.String() != want {
+			t.Fatal("content is changed")
+		}
+	}
+}
+
+func BenchmarkServeSmallFiles(b *testing.B) {
+	dir := b.TempDir()
+	const files = 2000
+	for i := 0; i < files; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%04d.txt", i)), []byte("small"), 0600); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, cache := range []bool{false, true} {
+		fs, err := newFileServer(Parameters{Paths: []string{dir}, CacheListings: cache}, func(Event) {})
+		if err != nil {
+			b.Fatal(err)
+		}
+		root := "/" + filepath.Base(dir) + "/"
+		b.Run(fmt.Sprintf("listing/cache=%v", cache), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if w := get(fs, root); w.Code != http.StatusOK {
+					b.Fatal(w.Code)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("file/cache=%v", cache), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if w := get(fs, fmt.Sprintf("%sfile-%04d.txt", root, i%files)); w.Code != http.StatusOK {
+					b.Fatal(w.Code)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("zip/cache=%v", cache), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := fs.writeZip(io.Discard, root); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
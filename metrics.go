@@ -0,0 +1,116 @@
+// metrics.go - expose statistics of a share in Prometheus format.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nogoegst/bulb"
+)
+
+// statusCounts counts responses by status code.
+type statusCounts struct {
+	mu sync.Mutex
+	m  map[int]int64
+}
+
+func (sc *statusCounts) add(code int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.m == nil {
+		sc.m = make(map[int]int64)
+	}
+	sc.m[code]++
+}
+
+func (sc *statusCounts) snapshot() map[int]int64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return maps.Clone(sc.m)
+}
+
+// countMisses counts requests answered by miss.
+func (s *Service) countMisses(miss http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.stats.misses.Add(1)
+		miss.ServeHTTP(w, req)
+	})
+}
+
+// torEvent counts uploads of descriptors of the onion among tor
+// events.
+func (s *Service) torEvent(resp *bulb.Response) {
+	f := strings.Fields(resp.Reply)
+	if len(f) >= 3 && f[0] == "HS_DESC" && f[1] == "UPLOADED" && f[2] == s.onion.ID {
+		s.stats.descriptorUploads.Add(1)
+	}
+}
+
+// listenMetrics listens on addr to serve metrics at. Only loopback
+// addresses are allowed: metrics are not for the onion.
+func listenMetrics(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metrics address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("Metrics address %s is not a loopback one", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for metrics: %v", err)
+	}
+	return l, nil
+}
+
+// metricsHandler serves metrics of the share at /metrics.
+func (s *Service) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+	return mux
+}
+
+// writeMetrics writes metrics of the share to w in Prometheus text
+// format.
+func (s *Service) writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+	}
+	st := s.Stats()
+	metric("onionize_connections_total", "counter", "Connections accepted.", st.Connections)
+	metric("onionize_active_connections", "gauge", "Connections open now.", s.stats.active.Load())
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", "onionize_requests_total",
+		"Requests which passed the checks by status of response.", "onionize_requests_total")
+	statuses := s.stats.statuses.snapshot()
+	for _, code := range slices.Sorted(maps.Keys(statuses)) {
+		fmt.Fprintf(w, "onionize_requests_total{code=\"%d\"} %d\n", code, statuses[code])
+	}
+	metric("onionize_misses_total", "counter", "Requests with wrong slug or required header.", s.stats.misses.Load())
+	metric("onionize_downloads_total", "counter", "Completed downloads.", st.Downloads)
+	metric("onionize_sent_bytes_total", "counter", "Bytes of responses sent.", st.BytesSent)
+	if s.onion == nil {
+		return
+	}
+	metric("onionize_descriptor_uploads_total", "counter", "Uploads of the onion service descriptor since it was published.", s.stats.descriptorUploads.Load())
+	connected := int64(1)
+	if s.onion.lost() != nil {
+		connected = 0
+	}
+	metric("onionize_tor_connected", "gauge", "Whether connection to tor is alive.", connected)
+	metric("onionize_tor_reconnects_total", "counter", "Times the onion was published again after connection to tor was lost.", s.stats.torReconnects.Load())
+}
@@ -0,0 +1,54 @@
+package onionize
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsTorReconnects(t *testing.T) {
+	ft := newFake(t)
+	events := make(chan Event, 16)
+	s, err := New(context.Background(), Parameters{
+		Text:         "hi",
+		DialControl:  ft.Dial,
+		ReconnectTor: true,
+		Events:       events,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Shutdown(context.Background())
+	metrics := func() string {
+		var b strings.Builder
+		s.writeMetrics(&b)
+		return b.String()
+	}
+	if m := metrics(); !strings.Contains(m, "\nonionize_tor_reconnects_total 0\n") {
+		t.Fatalf("no reconnects are counted before connection is lost:\n%s", m)
+	}
+	ft.DropConnections()
+	timeout := time.After(10 * time.Second)
+	for reconnected := false; !reconnected; {
+		select {
+		case ev := <-events:
+			_, reconnected = ev.(TorReconnected)
+		case <-timeout:
+			t.Fatal("onion is not published again")
+		}
+	}
+	m := metrics()
+	for _, want := range []string{
+		"\nonionize_tor_reconnects_total 1\n",
+		"\nonionize_tor_connected 1\n",
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("no %q in metrics:\n%s", strings.TrimSpace(want), m)
+		}
+	}
+}
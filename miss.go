@@ -0,0 +1,90 @@
+// miss.go - answer requests with a wrong slug.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Policies of responses to requests with a wrong slug (or without
+// the required header).
+const (
+	// Respond with plain 404 Not Found (default).
+	MissNotFound = "not-found"
+	// Reset the connection without responding.
+	MissReset = "reset"
+	// Respond with a decoy page as if it was all there is.
+	MissDecoy = "decoy"
+)
+
+const defaultDecoyPage = `<!doctype html>
+<title>Welcome</title>
+<h1>It works!</h1>
+`
+
+// newMissHandler returns handler answering misses according to
+// policy. Whatever the policy, misses are answered with content
+// prepared beforehand, without looking at the share, so it takes
+// the same time regardless of what's shared.
+func newMissHandler(policy, decoy string) (http.Handler, error) {
+	switch policy {
+	case "", MissNotFound:
+		return http.HandlerFunc(http.NotFound), nil
+	case MissReset:
+		return http.HandlerFunc(resetConn), nil
+	case MissDecoy:
+		if decoy == "" {
+			decoy = defaultDecoyPage
+		}
+		body := []byte(decoy)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body)
+		}), nil
+	default:
+		return nil, fmt.Errorf("Unknown policy on miss: %q", policy)
+	}
+}
+
+// resetConn closes connection of req without responding, with RST
+// if it is a TCP connection. It falls back to 404 if the connection
+// can't be taken over (e.g. HTTP/2).
+func resetConn(w http.ResponseWriter, req *http.Request) {
+	rc := http.NewResponseController(w)
+	conn, _, err := rc.Hijack()
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if tcp := tcpConn(conn); tcp != nil {
+		tcp.SetLinger(0)
+	}
+	// Close the outermost conn to let wrappers clean up
+	conn.Close()
+}
+
+// tcpConn returns TCP connection c wraps (nil if it's not one).
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			return cc
+		case *tls.Conn:
+			c = cc.NetConn()
+		case *limitedConn:
+			c = cc.Conn
+		default:
+			return nil
+		}
+	}
+}
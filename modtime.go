@@ -0,0 +1,55 @@
+// modtime.go - hide modification times of served files.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// maskedFileInfo reports zero modification time. http.FileServer
+// omits Last-Modified for it.
+type maskedFileInfo struct {
+	os.FileInfo
+}
+
+func (maskedFileInfo) ModTime() time.Time { return time.Time{} }
+
+// maskedFS hides modification times of files in vfs.FileSystem.
+type maskedFS struct {
+	vfs.FileSystem
+}
+
+func (f maskedFS) Lstat(p string) (os.FileInfo, error) {
+	fi, err := f.FileSystem.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return maskedFileInfo{fi}, nil
+}
+
+func (f maskedFS) Stat(p string) (os.FileInfo, error) {
+	fi, err := f.FileSystem.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return maskedFileInfo{fi}, nil
+}
+
+func (f maskedFS) ReadDir(p string) ([]os.FileInfo, error) {
+	fis, err := f.FileSystem.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range fis {
+		fis[i] = maskedFileInfo{fi}
+	}
+	return fis, nil
+}
@@ -0,0 +1,228 @@
+// onion.go - create onion services via control port.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/nogoegst/bulb"
+)
+
+// Actions to take when tor already runs an onion service with the
+// requested key.
+const (
+	// Return an error (default).
+	OnExistingFail = "fail"
+	// Adopt the existing onion service if it's a detached one, e.g.
+	// left by a previous run. Tor doesn't tell where ports of onions
+	// lead, so it's published again with ports of this share. Onions
+	// of other running controllers are never taken over.
+	OnExistingReuse = "reuse"
+	// Delete the existing onion service and create it anew.
+	OnExistingRecreate = "recreate"
+)
+
+// OnionOptions are options of the onion service passed to tor in
+// ADD_ONION. Tor has no options to restrict address families or
+// choose introduction points of the service: use ClientUseIPv4,
+// ClientUseIPv6 and such in torrc to control its network behavior.
+type OnionOptions struct {
+	// Detach keeps the onion service running after onionize
+	// disconnects from tor. It is gone only when tor exits or it is
+	// deleted via DEL_ONION.
+	Detach bool
+	// NonAnonymous creates a single onion service which is not
+	// hiding the location of the server. Tor must be running
+	// with HiddenServiceSingleHopMode and
+	// HiddenServiceNonAnonymousMode.
+	NonAnonymous bool
+}
+
+func (o OnionOptions) validate(p Parameters) error {
+	if o.Detach && p.TTL > 0 {
+		return errors.New("Detached onion would outlive share TTL")
+	}
+	if o.Detach && p.StopAfter > 0 {
+		return errors.New("Detached onion would outlive share download limit")
+	}
+	return nil
+}
+
+func (o OnionOptions) apply(nocfg *onionConfig) {
+	nocfg.Detach = o.Detach
+	nocfg.NonAnonymous = o.NonAnonymous
+}
+
+// onionConfig is bulb.NewOnionConfig with options bulb
+// doesn't support.
+type onionConfig struct {
+	bulb.NewOnionConfig
+	// ClientAuthV3 are base32-encoded x25519 public keys of
+	// clients authorized to connect.
+	ClientAuthV3 []string
+	// ClientAuth are names of v2 clients to generate auth
+	// cookies for. Requires BasicAuth.
+	ClientAuth []string
+}
+
+// addOnion issues an ADD_ONION command using cfg the same way
+// bulb.Conn.NewOnion does. PrivateKey of cfg must be supported
+// by bulb (see bulbKey) and returned private keys are not parsed.
+func addOnion(c *bulb.Conn, cfg *onionConfig) (*bulb.OnionInfo, error) {
+	if len(cfg.PortSpecs) == 0 {
+		return nil, errors.New("No ports to add onion with")
+	}
+	var keyStr string
+	switch k := cfg.PrivateKey.(type) {
+	case nil:
+		keyStr = "NEW:BEST"
+	case *rsa.PrivateKey:
+		keyStr = "RSA1024:" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PrivateKey(k))
+	case *bulb.OnionPrivateKey:
+		keyStr = k.KeyType + ":" + k.Key
+	default:
+		return nil, fmt.Errorf("Unsupported type of onion key: %T", k)
+	}
+	args := []string{"ADD_ONION", keyStr}
+	var flags []string
+	if cfg.DiscardPK {
+		flags = append(flags, "DiscardPK")
+	}
+	if cfg.Detach {
+		flags = append(flags, "Detach")
+	}
+	if cfg.BasicAuth {
+		flags = append(flags, "BasicAuth")
+	}
+	if cfg.NonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	if len(flags) != 0 {
+		args = append(args, "Flags="+strings.Join(flags, ","))
+	}
+	for _, ps := range cfg.PortSpecs {
+		port := fmt.Sprintf("Port=%d", ps.VirtPort)
+		if ps.Target != "" {
+			port += "," + ps.Target
+		}
+		args = append(args, port)
+	}
+	for _, name := range cfg.ClientAuth {
+		args = append(args, "ClientAuth="+name)
+	}
+	for _, key := range cfg.ClientAuthV3 {
+		args = append(args, "ClientAuthV3="+key)
+	}
+	resp, err := c.Request("%s", strings.Join(args, " "))
+	if err != nil {
+		return nil, err
+	}
+	oi := &bulb.OnionInfo{RawResponse: resp}
+	for _, l := range resp.Data {
+		if strings.HasPrefix(l, "ServiceID=") {
+			oi.OnionID = strings.TrimPrefix(l, "ServiceID=")
+		}
+	}
+	if oi.OnionID == "" {
+		return nil, errors.New("Tor didn't tell onion address")
+	}
+	if cfg.AwaitForUpload {
+		// Wait for service descriptor upload
+		c.StartAsyncReader()
+		if _, err := c.Request("SETEVENTS HS_DESC"); err != nil {
+			return nil, fmt.Errorf("SETEVENTS HS_DESC has failed: %v", err)
+		}
+		eventPrefix := fmt.Sprintf("HS_DESC UPLOADED %s", oi.OnionID)
+		for {
+			ev, err := c.NextEvent()
+			if err != nil {
+				return nil, fmt.Errorf("NextEvent has failed: %v", err)
+			}
+			if strings.HasPrefix(ev.Reply, eventPrefix) {
+				break
+			}
+		}
+	}
+	return oi, nil
+}
+
+func isOnionCollision(err error) bool {
+	terr, ok := err.(*textproto.Error)
+	if !ok {
+		return false
+	}
+	return terr.Code == bulb.StatusErrUnspecifiedTorError &&
+		strings.Contains(terr.Msg, "collision")
+}
+
+// detachedOnions returns IDs of detached onions tor runs.
+func detachedOnions(c *bulb.Conn) ([]string, error) {
+	resp, err := c.Request("GETINFO onions/detached")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, l := range resp.Data {
+		// Several IDs come as data reply lines
+		ids = append(ids, strings.Fields(strings.TrimPrefix(l, "onions/detached="))...)
+	}
+	return ids, nil
+}
+
+// newOnion creates an onion service using nocfg and resolves
+// a collision with an already existing one according to onExisting.
+func newOnion(c *bulb.Conn, nocfg *onionConfig, onExisting string, log *slog.Logger) (*bulb.OnionInfo, error) {
+	switch onExisting {
+	case "", OnExistingFail, OnExistingReuse, OnExistingRecreate:
+	default:
+		return nil, fmt.Errorf("Unknown action on existing onion: %q", onExisting)
+	}
+	cfg := *nocfg
+	cfg.PrivateKey = bulbKey(nocfg.PrivateKey)
+	oi, err := addOnion(c, &cfg)
+	if err == nil || !isOnionCollision(err) || nocfg.PrivateKey == nil {
+		return oi, err
+	}
+	onionID, aerr := onionAddress(nocfg.PrivateKey)
+	if aerr != nil {
+		return nil, fmt.Errorf("%v (unable to tell which onion it is: %v)", err, aerr)
+	}
+	switch onExisting {
+	case OnExistingReuse:
+		detached, err := detachedOnions(c)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list detached onions: %v", err)
+		}
+		if !slices.Contains(detached, onionID) {
+			log.Error("Onion already exists and isn't detached, unable to reuse it", "onion", onionID)
+			return nil, fmt.Errorf("Onion %s.onion already exists and is run by another controller", onionID)
+		}
+		log.Info("Onion already exists, adopting it with ports of this share", "onion", onionID)
+		if err := c.DeleteOnion(onionID); err != nil {
+			return nil, fmt.Errorf("Unable to take over existing onion: %v", err)
+		}
+		return addOnion(c, &cfg)
+	case OnExistingRecreate:
+		log.Info("Onion already exists, recreating it", "onion", onionID)
+		if err := c.DeleteOnion(onionID); err != nil {
+			return nil, fmt.Errorf("Unable to delete existing onion: %v", err)
+		}
+		return addOnion(c, &cfg)
+	default:
+		log.Error("Onion already exists, giving up", "onion", onionID)
+		return nil, fmt.Errorf("Onion %s.onion already exists", onionID)
+	}
+}
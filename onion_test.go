@@ -0,0 +1,222 @@
+package onionize
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nogoegst/bulb"
+	"github.com/nogoegst/onionize/faketor"
+	"github.com/nogoegst/onionutil"
+)
+
+// dialFake returns authenticated control connection to ft.
+func dialFake(t *testing.T, ft *faketor.Server) *bulb.Conn {
+	t.Helper()
+	conn, err := ft.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := bulb.NewConn(conn)
+	t.Cleanup(func() { c.Close() })
+	if err := authenticate(c, ""); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newFake(t *testing.T) *faketor.Server {
+	t.Helper()
+	ft, err := faketor.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ft.Close() })
+	return ft
+}
+
+func TestNewOnionCollision(t *testing.T) {
+	edKey, err := onionutil.GenerateOnionKeyV3(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := onionutil.OnionAddress(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torFormat, err := ExportKey(edKey, KeyFormatTor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torKey, err := ParseKey(torFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tc := range []struct {
+		name string
+		key  any
+	}{
+		{"ed25519", edKey},
+		{"tor", torKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ft := newFake(t)
+			nocfg := &onionConfig{NewOnionConfig: bulb.NewOnionConfig{
+				PortSpecs:  []bulb.OnionPortSpec{{VirtPort: 80, Target: "127.0.0.1:1"}},
+				PrivateKey: tc.key,
+				Detach:     true,
+			}}
+			oi, err := newOnion(dialFake(t, ft), nocfg, OnExistingFail, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if oi.OnionID != want {
+				t.Fatalf("onion is %s, want %s", oi.OnionID, want)
+			}
+			c := dialFake(t, ft)
+			_, err = newOnion(c, nocfg, OnExistingFail, log)
+			if err == nil || !strings.Contains(err.Error(), "already exists") {
+				t.Fatalf("creating existing onion with %q: %v", OnExistingFail, err)
+			}
+			oi, err = newOnion(c, nocfg, OnExistingReuse, log)
+			if err != nil {
+				t.Fatalf("creating existing onion with %q: %v", OnExistingReuse, err)
+			}
+			if oi.OnionID != want {
+				t.Fatalf("onion with %q is %s, want %s", OnExistingReuse, oi.OnionID, want)
+			}
+			oi, err = newOnion(c, nocfg, OnExistingRecreate, log)
+			if err != nil {
+				t.Fatalf("creating existing onion with %q: %v", OnExistingRecreate, err)
+			}
+			if oi.OnionID != want {
+				t.Fatalf("onion with %q is %s, want %s", OnExistingRecreate, oi.OnionID, want)
+			}
+			if _, ok := ft.Onion(want); !ok {
+				t.Fatal("onion is gone after recreation")
+			}
+		})
+	}
+}
+
+func TestNewOnionReuseAttached(t *testing.T) {
+	edKey, err := onionutil.GenerateOnionKeyV3(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ft := newFake(t)
+	nocfg := &onionConfig{NewOnionConfig: bulb.NewOnionConfig{
+		PortSpecs:  []bulb.OnionPortSpec{{VirtPort: 80, Target: "127.0.0.1:1"}},
+		PrivateKey: edKey,
+	}}
+	if _, err := newOnion(dialFake(t, ft), nocfg, OnExistingFail, log); err != nil {
+		t.Fatal(err)
+	}
+	// Onion of a running controller isn't taken over
+	_, err = newOnion(dialFake(t, ft), nocfg, OnExistingReuse, log)
+	if err == nil || !strings.Contains(err.Error(), "another controller") {
+		t.Fatalf("reusing onion of another controller: %v", err)
+	}
+}
+
+func TestDetachedOnions(t *testing.T) {
+	ft := newFake(t)
+	c := dialFake(t, ft)
+	var want []string
+	for i := 0; i < 3; i++ {
+		ids, err := detachedOnions(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, want) {
+			t.Fatalf("detached onions are %v, want %v", ids, want)
+		}
+		oi, err := addOnion(c, &onionConfig{NewOnionConfig: bulb.NewOnionConfig{
+			PortSpecs: []bulb.OnionPortSpec{{VirtPort: 80}},
+			Detach:    true,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, oi.OnionID)
+		slices.Sort(want)
+	}
+}
+
+func TestOnionOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	writeFile(t, path, "a")
+	for _, tc := range []struct {
+		name  string
+		p     Parameters
+		check func(faketor.Onion) error
+	}{
+		{"default", Parameters{}, func(o faketor.Onion) error {
+			if o.Detached() || slices.Contains(o.Flags, "NonAnonymous") || !slices.Contains(o.Flags, "DiscardPK") {
+				return fmt.Errorf("flags are %v", o.Flags)
+			}
+			if len(o.Ports) != 1 || o.Target(80) == "" {
+				return fmt.Errorf("ports are %v", o.Ports)
+			}
+			return nil
+		}},
+		{"detach", Parameters{Onion: OnionOptions{Detach: true}}, func(o faketor.Onion) error {
+			if !o.Detached() {
+				return fmt.Errorf("flags are %v", o.Flags)
+			}
+			return nil
+		}},
+		{"non-anonymous", Parameters{Onion: OnionOptions{NonAnonymous: true}}, func(o faketor.Onion) error {
+			if !slices.Contains(o.Flags, "NonAnonymous") {
+				return fmt.Errorf("flags are %v", o.Flags)
+			}
+			return nil
+		}},
+		{"ports", Parameters{VirtualPorts: []uint16{8080, 80}}, func(o faketor.Onion) error {
+			if len(o.Ports) != 2 || o.Target(8080) != o.Target(80) {
+				return fmt.Errorf("ports are %v", o.Ports)
+			}
+			return nil
+		}},
+		{"client auth", Parameters{ClientAuthNew: 2}, func(o faketor.Onion) error {
+			if len(o.ClientAuthV3) != 2 {
+				return fmt.Errorf("v3 clients are %v", o.ClientAuthV3)
+			}
+			return nil
+		}},
+		{"v2 client auth", Parameters{KeyType: KeyTypeRSA1024, ClientAuthNew: 2}, func(o faketor.Onion) error {
+			if !slices.Contains(o.Flags, "BasicAuth") || len(o.ClientAuth) != 2 {
+				return fmt.Errorf("flags are %v, v2 clients are %v", o.Flags, o.ClientAuth)
+			}
+			return nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.p.Pathspec = path
+			_, onion := share(t, newFake(t), tc.p)
+			if err := tc.check(onion); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOnionOptionsValidate(t *testing.T) {
+	for _, p := range []Parameters{
+		{Onion: OnionOptions{Detach: true}, TTL: time.Hour},
+		{Onion: OnionOptions{Detach: true}, StopAfter: 1},
+	} {
+		if err := p.Onion.validate(p); err == nil {
+			t.Errorf("detached onion with TTL %v and StopAfter %d is accepted", p.TTL, p.StopAfter)
+		}
+	}
+}
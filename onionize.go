@@ -8,188 +8,755 @@
 package onionize
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
-	"log"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
+	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/nogoegst/bulb"
-	"github.com/nogoegst/fileserver"
 	"github.com/nogoegst/onionize/util"
 	"github.com/nogoegst/onionutil"
+	"golang.org/x/tools/godoc/vfs"
 )
 
-const slugLength = 16
+const defaultSlugLength = 16
 
 type Parameters struct {
-	Pathspec        string
-	Zip             bool
-	Slug            bool
-	ControlPath     string
+	Pathspec string
+	// Zip serves contents of zip, tar, tar.gz or tar.xz archive at
+	// Pathspec. Format is detected by contents of the archive.
+	Zip  bool
+	Slug bool
+	// ControlPath is the tor control address: "tcp://host:port",
+	// "unix://path" or a port. If it is empty or "default://",
+	// tor is looked for at TOR_CONTROL_IPC_PATH or
+	// TOR_CONTROL_HOST:TOR_CONTROL_PORT, system tor's control
+	// socket and ports 9051 (system tor) and 9151 (Tor Browser).
+	ControlPath string
+	// ControlPassword is the password for HASHEDPASSWORD
+	// authentication, TOR_CONTROL_PASSWD by default.
 	ControlPassword string
-	Passphrase      string
-	Debug           bool
-	IdentityKey     crypto.PrivateKey
-	TLSConfig       *tls.Config
-	NoOnion         bool
-	StartTor        bool
+	// DialControl connects to tor control port instead of
+	// ControlPath if set, e.g. to a fake tor in tests (see package
+	// faketor). StartTor and StartTorIfNeeded are ignored then.
+	DialControl func() (net.Conn, error)
+	Passphrase  string
+	// Debug logs debug messages (unless Logger is set) and
+	// shows what's sent over tor control connection.
+	Debug       bool
+	IdentityKey crypto.PrivateKey
+	TLSConfig   *tls.Config
+	NoOnion     bool
+	// StartTor runs a tor instance of our own in a temporary
+	// data directory instead of connecting to ControlPath. It is
+	// stopped and its data is removed once the share is over.
+	StartTor bool
+	// OnExisting selects what to do if the onion service with
+	// the same key is already running: OnExistingFail (default),
+	// OnExistingReuse or OnExistingRecreate.
+	OnExisting string
+	// CacheListings renders directory listings once and serves
+	// them from memory until entries of the directory change
+	// (are added, removed, renamed or resized). File metadata is
+	// cached for a few seconds too. Use it for mostly static
+	// content.
+	CacheListings bool
+	// FS is served instead of Pathspec if set.
+	FS fs.FS
+	// FileSystem is served instead of Pathspec if set. Takes
+	// precedence over FS.
+	FileSystem vfs.FileSystem
+	// Content is read up to EOF and served from memory as a single
+	// file named ContentName instead of Pathspec if set.
+	Content     io.Reader
+	ContentName string
+	// Text is shown as a page with a copy button instead of
+	// sharing Pathspec if set. ContentName is its title.
+	Text string
+	// TextFormat is the format of Text: TextFormatPlain (default)
+	// or TextFormatMarkdown.
+	TextFormat string
+	// ConnIdleDeadline closes connections which haven't sent
+	// complete request headers (or finished TLS handshake) within
+	// this period. Connections idle between requests are not
+	// affected.
+	ConnIdleDeadline time.Duration
+	// Descriptor enables serving of share metadata (list of
+	// files and their sizes) at /.onionize/descriptor.json.
+	// The descriptor is built in background while the onion
+	// is being published.
+	Descriptor bool
+	// DescriptorChecksums adds SHA-256 checksums of files
+	// to the descriptor.
+	DescriptorChecksums bool
+	// Digests makes onionize compute SHA-256 of files once they
+	// are requested (of a single shared file right away) and send
+	// it in Repr-Digest and Content-Digest headers and as ETag,
+	// so clients can verify downloads and resume them with
+	// If-Range. Files are hashed in background: responses carry
+	// no digest until it's ready. DigestComputed is sent for
+	// every digest.
+	Digests bool
+	// SlugBruteforceDefense delays responses to requests with
+	// a wrong slug once they become frequent. The delay grows
+	// exponentially up to 10 seconds. Since misses can't be told
+	// apart by client, legitimate clients with wrong links are
+	// delayed too. Number of concurrently delayed responses is
+	// capped so the delay can't be used to exhaust resources.
+	SlugBruteforceDefense bool
+	// SlugBruteforceDefensePerClient acts as SlugBruteforceDefense
+	// accounting misses per client address. Over onion services
+	// all clients come from tor, so it makes difference only with
+	// Listener or NoOnion.
+	SlugBruteforceDefensePerClient bool
+	// MissPolicy selects how requests with a wrong slug (or
+	// without RequireHeader) are answered: MissNotFound (default),
+	// MissReset or MissDecoy.
+	MissPolicy string
+	// DecoyPage is HTML served on misses with MissDecoy. A blank
+	// "It works!" page is served by default.
+	DecoyPage string
+	// WellKnown maps names to contents of documents served under
+	// /.well-known/ (e.g. "security.txt"). They are served without
+	// slug, so anyone who knows the onion address can read them.
+	WellKnown map[string]string
+	// WarnSensitiveFiles makes onionize look for files that are
+	// likely to be shared by mistake (private keys, credentials)
+	// and report them. Files are matched against SensitivePatterns
+	// (DefaultSensitivePatterns if nil) and against permissions
+	// that grant access to the owner only.
+	WarnSensitiveFiles bool
+	SensitivePatterns  []string
+	// RefuseSensitiveFiles makes onionize refuse to share
+	// if there are any sensitive files found. Either of them
+	// fails shares which are not of files, e.g. of Text.
+	RefuseSensitiveFiles bool
+	// RampUp limits rate of every response to gradually
+	// growing value. Experimental.
+	RampUp *RampUp
+	// ExportKeyPath is the path to write onion private key to
+	// in tor's format (see KeyFormatTor). If no key is provided,
+	// a new key of KeyType is generated. It can't be used with
+	// KeyOut.
+	ExportKeyPath string
+	// TTL is the time the share stays up after it has been
+	// published. Zero means forever. Once it's over, no more
+	// requests are accepted, requests in progress are given a
+	// minute to complete, then the HTTP server is stopped and the
+	// onion service is removed.
+	TTL time.Duration
+	// ShowExpiry tells clients when the share is going to expire
+	// via X-Share-Expires header and at /.onionize/expiry
+	// (as JSON). Requires TTL.
+	ShowExpiry bool
+	// RequireHeadFirst makes GET requests for files fail with 428
+	// unless there was a HEAD request for the same file within a
+	// minute. This is a best-effort measure against crawlers and
+	// prefetching: clients can't be told apart over tor, so a HEAD
+	// by anyone enables downloads for everyone.
+	RequireHeadFirst bool
+	// SlugFunc produces the slug instead of random generation.
+	// Its result must pass ValidateSlug.
+	SlugFunc func() (string, error)
+	// Listener is served on instead of creating an onion service
+	// if set. The link then points to the listener's address.
+	Listener net.Listener
+	// MaskModTimes hides modification times of shared files:
+	// no Last-Modified headers are sent. This disables
+	// conditional requests based on modification time, listings
+	// are still validated by their ETags.
+	MaskModTimes bool
+	// Onion holds options of the onion service.
+	Onion OnionOptions
+	// RequireHeader makes requests without this header (with
+	// exactly this value) fail the same way as ones with wrong slug.
+	RequireHeader *RequireHeader
+	// KeyType is the type of onion key to generate or derive from
+	// Passphrase: KeyTypeED25519V3 (default) or KeyTypeRSA1024.
+	KeyType string
+	// KeyOut receives onion private key (PEM if possible, see
+	// KeyFormatPEM). A new key is generated if none is provided.
+	// It can't be used with ExportKeyPath.
+	KeyOut io.Writer
+	// KeyIn is the path to onion private key to use, in any
+	// format ExportKey produces. Only one of Passphrase, KeyIn,
+	// IdentityPath and IdentityKey can be set.
+	KeyIn string
+	// IdentityPath is the path to onion private key to use,
+	// like KeyIn. If there is no such file, a new key of KeyType
+	// is generated and saved there (readable by owner only), so
+	// the share keeps its address across restarts.
+	IdentityPath string
+	// NoIndex disables directory listings: requests for
+	// directories without index.html get 404. Note that Descriptor
+	// still lists all the files.
+	NoIndex bool
+	// ZipDir serves Pathspec as a single zip archive made on the
+	// fly. Symlinks are followed only to files inside shared
+	// directories.
+	ZipDir bool
+	// SlugLength is the length of random slugs (16 by default).
+	SlugLength int
+	// SlugValue is used as the slug instead of random one if set.
+	// It must pass ValidateSlug.
+	SlugValue string
+	// PassphraseSlug derives the slug from Passphrase along with
+	// the onion key, so the whole link stays the same across
+	// restarts. The slug is random otherwise.
+	PassphraseSlug bool
+	// StopAfter stops the share after content was completely
+	// downloaded this many times. Listings and partial downloads
+	// don't count. No more requests are accepted then, downloads
+	// in progress are let to complete however long they take and
+	// the share is torn down. Proxied sites can't be limited this
+	// way.
+	StopAfter int
+	// BasicAuthUser and BasicAuthPassword require clients to
+	// authenticate with HTTP Basic authentication if either is set.
+	// Responses to wrong credentials are delayed once they become
+	// frequent as with SlugBruteforceDefense.
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// ForceDownload makes browsers save the file instead of
+	// displaying it if a single file is shared. The file is saved
+	// under its name in the share, however unusual it is.
+	ForceDownload bool
+	// ContentType is served as the type of the file of single file
+	// shares instead of one guessed from its name or contents,
+	// e.g. "text/plain; charset=utf-8".
+	ContentType string
+	// Paths are shared instead of Pathspec if set. Each path is
+	// shared under its basename, which must be unique.
+	Paths []string
+	// MaxConcurrent limits the number of requests served at once.
+	// Requests over the limit get 503. No limit if zero.
+	MaxConcurrent int
+	// RateLimit limits the number of requests per second (with
+	// bursts of as many). Requests over the limit get 503.
+	// No limit if zero.
+	RateLimit float64
+	// MaxRate limits total rate of responses to this many bytes
+	// per second. No limit if zero.
+	MaxRate int64
+	// MaxConns limits the number of connections open at once
+	// (idle keep-alive ones included). Connections over the limit
+	// wait to be accepted. Connections are closed once idle for
+	// a while or slow to send request headers, so they don't hold
+	// their slots. No limit if zero.
+	MaxConns int
+	// Logger receives log messages of the share. slog.Default
+	// is used if it's nil.
+	Logger *slog.Logger
+	// Templates override templates of pages: "listing" of
+	// directory listings (executed with Listing), "landing"
+	// (executed with ListingEntry) and "text" (executed with
+	// TextPage). Those not defined are default ones.
+	Templates *template.Template
+	// LandingPage serves a page with name and size of the file
+	// and a download button at the root of single file shares
+	// instead of redirecting to the file.
+	LandingPage bool
+	// AccessLog receives a line of JSON for every request: its
+	// time, method, path, response status, bytes sent and whether
+	// it passed the slug check.
+	AccessLog io.Writer
+	// Events receives lifecycle events of the share if set.
+	// Events are dropped if the channel is not ready to receive.
+	Events chan<- Event
+	// VirtualPort is the port of the onion service (80 or, with
+	// TLS, 443 by default).
+	VirtualPort uint16
+	// VirtualPorts are more ports of the onion service leading to
+	// the share. The link points to VirtualPort.
+	VirtualPorts []uint16
+	// ClientAuthPubKeys are base32-encoded x25519 public keys of
+	// clients allowed to connect to the onion service (v3 client
+	// authorization). Other clients can't even reach it.
+	ClientAuthPubKeys []string
+	// Recipients are names of recipients to make links of their
+	// own for (see Service.AddRecipient). Requires Slug.
+	Recipients []string
+	// ClientAuthNew is the number of client key pairs to generate
+	// and authorize. Their private keys are passed in
+	// ResultLink.ClientAuth. For v2 onions tor generates auth
+	// cookies (HidServAuth) instead.
+	ClientAuthNew int
+	// ZipDownloads lets clients download any shared directory as
+	// a zip archive made on the fly by adding "?download=zip" to
+	// its URL. It has no effect with NoIndex.
+	ZipDownloads bool
+	// SeparateOnions shares every path of Paths or Pathspec via
+	// an onion service of its own. Each gets a new onion key.
+	// Supported by Onionize only: CreateOnion and New refuse it.
+	SeparateOnions bool
+	// Forwards make Onionize publish an onion service which
+	// forwards its ports to local targets instead of sharing
+	// anything over HTTP. The link then has the onion address
+	// only. Supported by Onionize only: CreateOnion and New refuse
+	// them.
+	Forwards []PortForward
+	// StartTorIfNeeded acts as StartTor if tor control port at
+	// ControlPath can't be connected to.
+	StartTorIfNeeded bool
+	// TorPath is tor binary to run for StartTor. Tor next to
+	// the executable or tor from PATH is used by default.
+	TorPath string
+	// ReceiveDir makes the share a drop box: instead of serving
+	// files it accepts uploads and writes them into ReceiveDir.
+	ReceiveDir string
+	// MaxUploadSize limits size of upload requests in bytes.
+	// No limit if zero.
+	MaxUploadSize int64
+	// WebDAV serves the directory at Pathspec over WebDAV so it
+	// can be mounted as a network drive. Clients may change its
+	// contents unless WebDAVReadOnly is set.
+	WebDAV         bool
+	WebDAVReadOnly bool
+	// ReconnectTor keeps the share up when connection to tor is
+	// lost (e.g. tor is restarted): onionize connects to tor again
+	// and publishes the onion with the same key. It has no effect on
+	// tor run by onionize.
+	ReconnectTor bool
+	// MetricsAddr is a loopback address (e.g. 127.0.0.1:9100) to
+	// serve metrics of the share at /metrics in Prometheus text
+	// format: connections, requests by status, misses, bytes
+	// sent and state of the onion service. It can't be used with
+	// SeparateOnions.
+	MetricsAddr string
 }
 
-func generateSlug() (string, error) {
+// defaultVirtualPort returns default port of the onion service.
+func defaultVirtualPort(p Parameters) uint16 {
+	if p.TLSConfig != nil {
+		return 443
+	}
+	return 80
+}
+
+// virtualPort returns port of the onion service.
+func virtualPort(p Parameters) uint16 {
+	if p.VirtualPort != 0 {
+		return p.VirtualPort
+	}
+	return defaultVirtualPort(p)
+}
+
+// virtualPorts returns all ports of the onion service, the one
+// of the link first.
+func virtualPorts(p Parameters) []uint16 {
+	ports := []uint16{virtualPort(p)}
+	for _, port := range p.VirtualPorts {
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// logger returns logger of the share described by p.
+func logger(p Parameters) *slog.Logger {
+	switch {
+	case p.Logger != nil:
+		return p.Logger
+	case p.Debug:
+		return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	default:
+		return slog.Default()
+	}
+}
+
+func generateSlug(slugLength int) (string, error) {
+	return readSlug(rand.Reader, slugLength)
+}
+
+// readSlug makes slug of slugLength out of bytes read from r.
+func readSlug(r io.Reader, slugLength int) (string, error) {
 	slugBin := make([]byte, (slugLength*5)/8+1)
-	_, err := rand.Read(slugBin)
+	_, err := io.ReadFull(r, slugBin)
 	if err != nil {
 		return "", err
 	}
 	return onionutil.Base32Encode(slugBin)[:slugLength], nil
 }
 
-func Onionize(p Parameters, linkChan chan<- url.URL) error {
-	// Run tor instance ourselves
-	if p.StartTor {
-		p.ControlPath = "tcp://127.0.0.1:9999"
-		torReady := make(chan struct{})
-		go func() {
-			err := runTor(torReady)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}()
-		<-torReady
+// passphraseIdentity derives onion key of p.KeyType and slug of
+// slugLength from p.Passphrase. The key is the same publishOnion
+// derives from it and the slug comes from a separate keystream.
+func passphraseIdentity(p Parameters, slugLength int) (string, crypto.PrivateKey, error) {
+	version, err := onionVersion(p.KeyType)
+	if err != nil {
+		return "", nil, err
+	}
+	secret := util.Secret([]byte(p.Passphrase), []byte("onionize-keygen"))
+	key, err := onionutil.GenerateOnionKey(util.SecretReader(secret, nil), version)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to generate onion key: %v", err)
+	}
+	slug, err := readSlug(util.SecretReader(secret, []byte("onionize-slug")), slugLength)
+	if err != nil {
+		return "", nil, err
+	}
+	return slug, key, nil
+}
+
+// Onionize shares content described by p via an onion service,
+// sends its link to linkChan and serves until the share is over.
+// With p.SeparateOnions a link is sent for every path.
+// With p.Forwards only the ports are forwarded.
+// Cancelling ctx shuts the share down gracefully: Onionize returns
+// after in-flight requests are completed.
+func Onionize(ctx context.Context, p Parameters, linkChan chan<- ResultLink) error {
+	if len(p.Forwards) != 0 {
+		return forward(ctx, p, linkChan)
+	}
+	if p.SeparateOnions {
+		return onionizeSeparately(ctx, p, linkChan)
 	}
+	s, err := New(ctx, p)
+	if err != nil {
+		return err
+	}
+	// Return the link to the service
+	select {
+	case linkChan <- ResultLink{URL: s.Link, Key: s.Key, ClientAuth: s.ClientAuth, Recipients: s.Recipients()}:
+	case <-ctx.Done():
+		<-s.Done()
+		return ctx.Err()
+	}
+	s.Start()
+	<-s.Done()
+	return s.Err()
+}
+
+// New creates the share described by p like CreateOnion and serves
+// it in background until ctx is done or Stop is called. Requests
+// are held until Start is called.
+func New(ctx context.Context, p Parameters) (*Service, error) {
+	s, err := CreateOnion(p)
+	if err != nil {
+		return nil, err
+	}
+	s.stopped = make(chan struct{})
+	go func() {
+		s.err = s.Serve()
+		close(s.stopped)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown(context.Background())
+		case <-s.stopped:
+		}
+	}()
+	return s, nil
+}
+
+// CreateOnion sets up the share described by p and publishes its
+// onion service. Requests are held until Service.Start is called.
+func CreateOnion(p Parameters) (s *Service, err error) {
+	if len(p.Forwards) != 0 {
+		return nil, fmt.Errorf("Forwards are supported by Onionize only")
+	}
+	if p.SeparateOnions {
+		return nil, fmt.Errorf("Separate onions are supported by Onionize only")
+	}
+	p.Logger = logger(p)
 	var handler http.Handler
 	var slug string
-	var err error
-	if p.Slug && !p.NoOnion {
-		slug, err = generateSlug()
+	useOnion := !p.NoOnion && p.Listener == nil
+	if p.Slug && useOnion {
+		// The passphrase is turned into IdentityKey below
+		if err := checkKeySources(p); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.SlugValue != "":
+			slug = p.SlugValue
+			err = ValidateSlug(slug)
+		case p.SlugFunc != nil:
+			slug, err = p.SlugFunc()
+			if err == nil {
+				err = ValidateSlug(slug)
+			}
+		case p.SlugLength < 0 || p.SlugLength > maxSlugLength:
+			err = fmt.Errorf("slug length must be up to %d", maxSlugLength)
+		case p.PassphraseSlug && p.Passphrase != "":
+			length := p.SlugLength
+			if length == 0 {
+				length = defaultSlugLength
+			}
+			slug, p.IdentityKey, err = passphraseIdentity(p, length)
+			// The key is derived already
+			p.Passphrase = ""
+		case p.SlugLength == 0:
+			slug, err = generateSlug(defaultSlugLength)
+		default:
+			slug, err = generateSlug(p.SlugLength)
+		}
 		if err != nil {
-			return fmt.Errorf("Unable to generate slug: %v", err)
+			return nil, fmt.Errorf("Unable to generate slug: %v", err)
 		}
 	}
 
-	useOnion := !p.NoOnion
 	link := url.URL{Path: "/"}
-	var c *bulb.Conn
-	nocfg := &bulb.NewOnionConfig{
-		DiscardPK:      true,
-		AwaitForUpload: true,
-	}
 
-	if strings.HasPrefix(p.Pathspec, "http://") || strings.HasPrefix(p.Pathspec, "https://") {
-		target, err := url.Parse(p.Pathspec)
-		if err != nil {
-			return fmt.Errorf("Unable to parse target URL: %v", err)
+	s = &Service{
+		ttl:      p.TTL,
+		expiry:   &expiry{},
+		started:  make(chan struct{}),
+		stopping: make(chan struct{}),
+		events:   p.Events,
+		slugs:    newSlugRegistry(slug, p.SlugLength),
+	}
+	for _, name := range p.Recipients {
+		if _, err := s.slugs.add(name); err != nil {
+			return nil, err
 		}
-		handler = onionReverseHTTPProxy(target)
-	} else {
-		handler, err = fileserver.New(p.Pathspec, p.Zip, p.Debug)
+	}
+	completed := func(req *http.Request, n int64) {
+		s.stats.downloads.Add(1)
+		p.Logger.Debug("Download completed", "path", req.URL.Path, "remote", req.RemoteAddr, "bytes", n)
+		s.emit(DownloadCompleted{URL: req.URL.String(), Bytes: n})
+	}
+	var progress func(*http.Request, int64, int64)
+	if p.Events != nil {
+		progress = func(req *http.Request, n, total int64) {
+			s.emit(DownloadProgress{URL: req.URL.String(), Bytes: n, Total: total})
+		}
+	}
+	downloads := newDownloadCounter(p.StopAfter, func() {
+		s.Shutdown(context.Background())
+	}, completed, progress)
+	customFS := p.FS != nil || p.FileSystem != nil || p.Content != nil || p.Text != ""
+	var target *url.URL
+	isProxy := false
+	// sharedFS has the files served, if any
+	var sharedFS vfs.FileSystem
+	if p.ReceiveDir == "" && !p.WebDAV && !customFS && len(p.Paths) == 0 {
+		target, isProxy, err = proxyTarget(p.Pathspec)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	server := &http.Server{Handler: subdomainSluggedHandler(handler, slug)}
-
-	listenAddress := "127.0.0.1:0"
-	if useOnion {
-		// Connect to a running tor instance
-		if p.ControlPath == "" {
-			p.ControlPath = "default://"
+	if isProxy && p.StopAfter > 0 {
+		// Every asset of a proxied page would count as a download
+		return nil, fmt.Errorf("Download limit can't be applied to proxied sites")
+	}
+	if p.ReceiveDir != "" {
+		handler, err = newReceiver(p, s.emit)
+		if err != nil {
+			return nil, err
 		}
-		c, err = bulb.DialURL(p.ControlPath)
+	} else if p.WebDAV {
+		dav, err := newWebDAV(p, s.emit)
 		if err != nil {
-			return fmt.Errorf("Failed to connect to control socket: %v", err)
+			return nil, err
 		}
-		defer c.Close()
-
-		// See what's really going on under the hood
-		c.Debug(p.Debug)
-
-		// Authenticate with the control port
-		if err := c.Authenticate(p.ControlPassword); err != nil {
-			return fmt.Errorf("Authentication failed: %v", err)
+		dir, _ := webdavDir(p)
+		sharedFS = vfs.OS(dir)
+		handler = downloads.handler(dav, func(req *http.Request) bool {
+			return req.Method == http.MethodGet
+		})
+	} else if p.Text != "" {
+		tp, err := newTextPage(p)
+		if err != nil {
+			return nil, err
 		}
-		// Derive onion service keymaterial from passphrase or generate a new one
-		if p.Passphrase != "" {
-			keyrd := util.KeystreamReader([]byte(p.Passphrase), []byte("onionize-keygen"))
-			privOnionKey, err := onionutil.GenerateOnionKey(keyrd, "current")
-			if err != nil {
-				return fmt.Errorf("Unable to generate onion key: %v", err)
-			}
-			nocfg.PrivateKey = privOnionKey
-		} else {
-			nocfg.PrivateKey = p.IdentityKey
+		handler = downloads.handler(tp, tp.isDownload)
+	} else if isProxy {
+		handler = onionReverseHTTPProxy(target, logger(p))
+	} else if !customFS && p.ZipDir {
+		zd, err := newZipDir(p)
+		if err != nil {
+			return nil, err
 		}
+		handler = downloads.handler(zd, zd.isArchive)
+		link.Path = zd.name
+		sharedFS = aliasFS(zd.aliasmap)
 	} else {
+		fileSrv, err := newFileServer(p, s.emit)
+		if err != nil {
+			return nil, err
+		}
+		handler = downloads.handler(fileSrv, fileSrv.isDownload)
+		sharedFS = fileSrv.fs
+		if p.Descriptor {
+			handler = descriptorHandler(handler, fileSrv, p.DescriptorChecksums)
+		}
+	}
+	if p.WarnSensitiveFiles || p.RefuseSensitiveFiles {
+		if sharedFS == nil {
+			return nil, fmt.Errorf("Sensitive files can be looked for among shared files only")
+		}
+		if err := checkSensitiveFiles(sharedFS, p); err != nil {
+			return nil, err
+		}
+	}
+	if p.RampUp != nil {
+		if p.RampUp.Initial <= 0 || p.RampUp.Step < 0 || p.RampUp.Interval <= 0 {
+			return nil, fmt.Errorf("Invalid rate ramp-up parameters")
+		}
+		handler = rampHandler(handler, *p.RampUp)
+	}
+	handler = newByteLimiter(p.MaxRate).handler(handler)
+	e := s.expiry
+	if p.ShowExpiry && p.TTL > 0 {
+		handler = expiryHandler(handler, e)
+	}
+	if p.RequireHeader != nil && (p.RequireHeader.Name == "" || p.RequireHeader.Value == "") {
+		return nil, fmt.Errorf("Required header must have a name and a value")
+	}
+	var throttle throttler
+	switch {
+	case p.SlugBruteforceDefensePerClient:
+		throttle = newClientThrottles()
+	case p.SlugBruteforceDefense:
+		throttle = &missThrottle{}
+	}
+	miss, err := newMissHandler(p.MissPolicy, p.DecoyPage)
+	if err != nil {
+		return nil, err
+	}
+	miss = s.countMisses(miss)
+	// Requests with wrong slug don't count against the limits
+	handler = newRequestLimiter(p.MaxConcurrent, p.RateLimit).handler(handler)
+	handler = s.requestEvents(handler)
+	access := newAccessLog(p.AccessLog)
+	handler = access.slugPassed(handler)
+	handler = subdomainSluggedHandler(handler, s.slugs, p.RequireHeader, throttle, miss)
+	if p.BasicAuthUser != "" || p.BasicAuthPassword != "" {
+		// Guessing passwords is slowed down regardless of slugs
+		handler = basicAuthHandler(handler, p.BasicAuthUser, p.BasicAuthPassword, &missThrottle{})
+	}
+	if len(p.WellKnown) != 0 {
+		handler, err = wellKnownHandler(handler, p.WellKnown)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.server = &http.Server{
+		Handler:   access.handler(recoverHandler(s.gate(handler), logger(p))),
+		ConnState: s.connState,
+	}
+	if p.MaxConns > 0 {
+		// Don't let idle clients take up every slot
+		s.server.ReadHeaderTimeout = maxConnsHeaderTimeout
+		s.server.IdleTimeout = maxConnsIdleTimeout
+	}
+	if d := p.ConnIdleDeadline; d > 0 && (s.server.ReadHeaderTimeout == 0 || d < s.server.ReadHeaderTimeout) {
+		s.server.ReadHeaderTimeout = d
+	}
+
+	listenAddress := "127.0.0.1:0"
+	if !useOnion && p.Listener == nil {
 		tc, err := net.Dial("udp", "1.1.1.1:1")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer tc.Close()
 		host, _, err := net.SplitHostPort(tc.LocalAddr().String())
 		if err != nil {
-			return err
+			return nil, err
 		}
 		listenAddress = host + ":0"
 	}
 
 	var listener net.Listener
-	rawListener, err := net.Listen("tcp4", listenAddress)
-	if err != nil {
-		return err
+	rawListener := p.Listener
+	if rawListener == nil {
+		rawListener, err = net.Listen("tcp4", listenAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if err != nil {
+			rawListener.Close()
+		}
+	}()
+	var metricsListener net.Listener
+	if p.MetricsAddr != "" {
+		metricsListener, err = listenMetrics(p.MetricsAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				metricsListener.Close()
+			}
+		}()
+	}
+	if p.MaxConns > 0 {
+		rawListener = newConnLimitListener(rawListener, p.MaxConns)
 	}
 
-	var virtPort uint16
 	if p.TLSConfig != nil {
 		listener = tls.NewListener(rawListener, p.TLSConfig)
 		link.Scheme = "https"
-		virtPort = uint16(443)
 	} else {
 		listener = rawListener
 		link.Scheme = "http"
-		virtPort = uint16(80)
 	}
+	virtPort := virtualPort(p)
 
 	if useOnion {
-		portSpec := bulb.OnionPortSpec{
-			VirtPort: virtPort,
-			Target:   listener.Addr().String(),
+		var ports []bulb.OnionPortSpec
+		for _, port := range virtualPorts(p) {
+			ports = append(ports, bulb.OnionPortSpec{
+				VirtPort: port,
+				Target:   listener.Addr().String(),
+			})
 		}
-		nocfg.PortSpecs = []bulb.OnionPortSpec{portSpec}
-		oi, err := c.NewOnion(nocfg)
+		o, err := publishOnion(p, ports)
 		if err != nil {
-			return fmt.Errorf("Error occurred while creating an onion service: %v", err)
-		}
-		// Track if tor went down
-		// TODO: Signal from here to perform graceful shutdown and display a message
-		go func() {
-			for {
-				_, err := c.NextEvent()
-				if err != nil {
-					log.Fatalf("Lost connection to tor: %v", err)
-				}
-			}
-		}()
-
+			return nil, err
+		}
+		s.onion = o
+		s.Key = o.Key
+		s.ClientAuth = o.ClientAuth
+		s.onionHost = fmt.Sprintf("%s.onion", s.onion.ID)
+		if virtPort != defaultVirtualPort(p) {
+			s.onionHost = net.JoinHostPort(s.onionHost, strconv.Itoa(int(virtPort)))
+		}
+		link.Host = s.onionHost
 		if slug != "" {
-			link.Host = fmt.Sprintf("%s.%s.onion", slug, oi.OnionID)
-		} else {
-			link.Host = fmt.Sprintf("%s.onion", oi.OnionID)
+			link.Host = slug + "." + s.onionHost
 		}
 	} else {
 		link.Host = listener.Addr().String()
 	}
 
-	// Return the link to the service
-	linkChan <- link
-	// Run a webservice
-	err = server.Serve(listener)
-	if err != nil {
-		return fmt.Errorf("Cannot serve HTTP: %v", err)
+	s.Link = link
+	s.listener = listener
+	if s.onion != nil {
+		go s.onion.watch(s.torEvent, func(err error) {
+			s.emit(TorConnectionLost{Err: err})
+			if s.onion.reconnects() {
+				p.Logger.Warn("Lost connection to tor, reconnecting", "err", err)
+				return
+			}
+			s.server.Close()
+		}, func() {
+			s.stats.torReconnects.Add(1)
+			s.emit(TorReconnected{})
+		})
+	}
+	if metricsListener != nil {
+		s.metrics = &http.Server{Handler: s.metricsHandler()}
+		go s.metrics.Serve(metricsListener)
 	}
-	return nil
+	s.emit(OnionPublished{URL: link})
+	return s, nil
 }
@@ -0,0 +1,142 @@
+package onionize
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nogoegst/onionize/faketor"
+)
+
+// share runs Onionize with p over ft and returns the link and the
+// onion it's published at.
+func share(t *testing.T, ft *faketor.Server, p Parameters) (url.URL, faketor.Onion) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	p.DialControl = ft.Dial
+	if p.Logger == nil {
+		p.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	links := make(chan ResultLink, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- Onionize(ctx, p, links) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errc
+	})
+	var link ResultLink
+	select {
+	case link = <-links:
+	case err := <-errc:
+		t.Fatalf("Onionize: %v", err)
+	}
+	u := link.URL
+	onions := ft.Onions()
+	if len(onions) != 1 {
+		t.Fatalf("%d onions are published, want 1", len(onions))
+	}
+	if !strings.HasSuffix(u.Hostname(), onions[0].ID+".onion") {
+		t.Fatalf("link %s doesn't point to onion %s", &u, onions[0].ID)
+	}
+	return u, onions[0]
+}
+
+// fetch requests path of the share at host from the onion.
+func fetch(t *testing.T, o faketor.Onion, host, path string) (*http.Response, string) {
+	t.Helper()
+	return do(t, o, newOnionRequest(t, "GET", host, path))
+}
+
+// newOnionRequest returns request for path of the share at host.
+func newOnionRequest(t *testing.T, method, host, path string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+host+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// do sends req to the onion as tor would connect a client to it.
+func do(t *testing.T, o faketor.Onion, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	req.Host = req.URL.Host
+	req.URL.Host = o.Target(80)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestOnionizeSlug(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "share", "a.txt"), "a")
+	ft := newFake(t)
+	link, onion := share(t, ft, Parameters{Pathspec: filepath.Join(dir, "share"), Slug: true})
+	slug, _, ok := strings.Cut(link.Host, ".")
+	if !ok || ValidateSlug(slug) != nil {
+		t.Fatalf("link %s has no slug", &link)
+	}
+
+	resp, body := fetch(t, onion, link.Host, "/share/a.txt")
+	if resp.StatusCode != http.StatusOK || body != "a" {
+		t.Fatalf("with slug: %d %q", resp.StatusCode, body)
+	}
+	for _, host := range []string{
+		onion.ID + ".onion",
+		"wrongslug." + onion.ID + ".onion",
+		slug[1:] + "." + onion.ID + ".onion",
+	} {
+		if resp, _ := fetch(t, onion, host, "/share/a.txt"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("request to %s: %d, want 404", host, resp.StatusCode)
+		}
+	}
+}
+
+func TestOnionizeZip(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.zip")
+	writeZip(t, archive, map[string]string{"dir/a.txt": "a", "b.txt": "b"})
+	ft := newFake(t)
+	link, onion := share(t, ft, Parameters{Pathspec: archive, Zip: true, Slug: true})
+	for path, want := range map[string]string{"/dir/a.txt": "a", "/b.txt": "b"} {
+		resp, body := fetch(t, onion, link.Host, path)
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("%s: %d %q, want %q", path, resp.StatusCode, body, want)
+		}
+	}
+	if resp, body := fetch(t, onion, link.Host, "/"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "b.txt") {
+		t.Errorf("listing: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestOnionizeSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	writeFile(t, path, "report")
+	ft := newFake(t)
+	link, onion := share(t, ft, Parameters{Pathspec: path, Slug: true})
+	resp, _ := fetch(t, onion, link.Host, "/")
+	loc, err := link.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode/100 != 3 || err != nil {
+		t.Fatalf("root of single file share: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, body := fetch(t, onion, link.Host, loc.RequestURI())
+	if resp.StatusCode != http.StatusOK || body != "report" {
+		t.Fatalf("%s: %d %q", loc.RequestURI(), resp.StatusCode, body)
+	}
+}
@@ -8,19 +8,54 @@
 package onionize
 
 import (
-	"log"
-	"net/http"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 )
 
-func onionReverseHTTPProxy(target *url.URL) *httputil.ReverseProxy {
-	director := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.Host = target.Host
-		req.Header.Set("User-Agent", "onionize")
-		log.Printf("%v", req.URL)
+// proxyTarget returns URL of HTTP server to proxy to if pathspec is
+// its URL or host:port (":port" for localhost). host:port that is an
+// existing path with an alias is not a target.
+func proxyTarget(pathspec string) (*url.URL, bool, error) {
+	if strings.HasPrefix(pathspec, "http://") || strings.HasPrefix(pathspec, "https://") {
+		target, err := url.Parse(pathspec)
+		if err != nil {
+			return nil, true, fmt.Errorf("Unable to parse target URL: %v", err)
+		}
+		return target, true, nil
+	}
+	host, port, err := net.SplitHostPort(pathspec)
+	if err != nil || strings.ContainsAny(host, `/\`) {
+		return nil, false, nil
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, false, nil
+	}
+	if host == "" {
+		host = "localhost"
+	} else if _, err := os.Stat(host); err == nil {
+		return nil, false, nil
+	}
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}, true, nil
+}
+
+// onionReverseHTTPProxy proxies requests to target. Paths are
+// appended to the path of target and Host header is set to the
+// host of target, so the slug (which is a part of onion hostname)
+// never reaches the server.
+func onionReverseHTTPProxy(target *url.URL, log *slog.Logger) *httputil.ReverseProxy {
+	rewrite := func(pr *httputil.ProxyRequest) {
+		pr.SetURL(target)
+		pr.Out.Header.Set("User-Agent", "onionize")
+		log.Debug("Proxying", "url", pr.Out.URL.String(), "remote", pr.In.RemoteAddr)
+	}
+	return &httputil.ReverseProxy{
+		Rewrite:  rewrite,
+		ErrorLog: slog.NewLogLogger(log.Handler(), slog.LevelError),
 	}
-	return &httputil.ReverseProxy{Director: director}
 }
@@ -0,0 +1,28 @@
+package onionize
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("proxied " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	s, err := CreateOnion(Parameters{Pathspec: backend.URL, NoOnion: true, StopAfter: 1})
+	if err == nil {
+		s.Close()
+		t.Fatal("download limit is accepted for proxied site")
+	}
+
+	link, onion := share(t, newFake(t), Parameters{Pathspec: backend.URL, Slug: true})
+	for _, path := range []string{"/", "/style.css", "/favicon.ico", "/"} {
+		resp, body := fetch(t, onion, link.Host, path)
+		if resp.StatusCode != http.StatusOK || body != "proxied "+path {
+			t.Fatalf("%s: %d %q", path, resp.StatusCode, body)
+		}
+	}
+}
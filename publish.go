@@ -0,0 +1,367 @@
+// publish.go - publish onion services via tor.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nogoegst/bulb"
+	"github.com/nogoegst/onionize/util"
+	"github.com/nogoegst/onionutil"
+)
+
+// onionService is an onion service published via tor along with
+// the connection to tor it lives on and tor itself if it's run
+// by onionize. It knows nothing of what is served behind it.
+type onionService struct {
+	// ID is the onion address without ".onion"
+	ID string
+	// Key is onion private key written to Parameters.KeyOut.
+	Key []byte
+	// ClientAuth are credentials of generated clients.
+	ClientAuth []string
+	control    *bulb.Conn
+	tor        *torProcess
+	// owned is set if the onion is to be deleted when closed
+	owned  bool
+	mu     sync.Mutex
+	closed bool
+	// err is the error connection to tor was lost with
+	err error
+	// republish (if set) publishes the onion again via a new
+	// connection to tor
+	republish func() (*bulb.Conn, error)
+	// closing is closed by close
+	closing chan struct{}
+	log     *slog.Logger
+}
+
+// maxReconnectDelay is the longest delay between attempts to publish
+// onion again.
+const maxReconnectDelay = 30 * time.Second
+
+// publishOnion publishes an onion service mapping ports as
+// described by p: it runs tor if asked to, connects to it, picks
+// onion key and authorizes clients.
+func publishOnion(p Parameters, ports []bulb.OnionPortSpec) (o *onionService, err error) {
+	log := logger(p)
+	if err := p.Onion.validate(p); err != nil {
+		return nil, err
+	}
+	if err := checkKeySources(p); err != nil {
+		return nil, err
+	}
+	nocfg := &onionConfig{
+		NewOnionConfig: bulb.NewOnionConfig{
+			PortSpecs:      ports,
+			DiscardPK:      true,
+			AwaitForUpload: true,
+		},
+	}
+	p.Onion.apply(nocfg)
+	var clients []*clientAuthKey
+	for _, key := range p.ClientAuthPubKeys {
+		if err := validateClientAuthKey(key); err != nil {
+			return nil, err
+		}
+		nocfg.ClientAuthV3 = append(nocfg.ClientAuthV3, key)
+	}
+	for i := 0; i < p.ClientAuthNew; i++ {
+		k, err := generateClientAuth()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to generate client key: %v", err)
+		}
+		clients = append(clients, k)
+		nocfg.ClientAuthV3 = append(nocfg.ClientAuthV3, k.public)
+	}
+
+	o = &onionService{closing: make(chan struct{}), log: log}
+	runTor := p.StartTor
+	switch {
+	case p.DialControl != nil:
+		// Connection is up to the caller
+		runTor = false
+	case !runTor && isDefaultControlPath(p.ControlPath):
+		path, derr := DiscoverControlPath()
+		if derr != nil && !p.StartTorIfNeeded {
+			return nil, derr
+		}
+		p.ControlPath = path
+		runTor = derr != nil
+	case !runTor && p.StartTorIfNeeded:
+		runTor = !controlReachable(p.ControlPath)
+	}
+	// Run tor instance ourselves
+	if runTor {
+		o.tor, err = startTor(p.TorPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to run tor: %v", err)
+		}
+		defer func() {
+			if err != nil {
+				o.tor.stop()
+			}
+		}()
+		p.ControlPath = o.tor.controlPath
+	}
+	// Connect to a running tor instance
+	c, err := dialControl(p)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to control socket: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+	o.control = c
+
+	// See what's really going on under the hood
+	c.Debug(p.Debug)
+
+	// Authenticate with the control port
+	if err := authenticate(c, controlPassword(p.ControlPassword)); err != nil {
+		return nil, fmt.Errorf("Authentication failed: %v", err)
+	}
+	if o.tor != nil {
+		if err := o.tor.takeOwnership(c); err != nil {
+			return nil, fmt.Errorf("Unable to bootstrap tor: %v", err)
+		}
+	}
+	version, err := onionVersion(p.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	// Derive onion service keymaterial from passphrase or generate a new one
+	if p.Passphrase != "" {
+		keyrd := util.KeystreamReader([]byte(p.Passphrase), []byte("onionize-keygen"))
+		privOnionKey, err := onionutil.GenerateOnionKey(keyrd, version)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to generate onion key: %v", err)
+		}
+		nocfg.PrivateKey = privOnionKey
+	} else if p.KeyIn != "" {
+		b, err := ioutil.ReadFile(p.KeyIn)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read onion key: %v", err)
+		}
+		nocfg.PrivateKey, err = ParseKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse onion key: %v", err)
+		}
+	} else if p.IdentityPath != "" {
+		nocfg.PrivateKey, err = loadIdentity(p.IdentityPath, log)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nocfg.PrivateKey = p.IdentityKey
+	}
+	// Save a new identity on first run
+	newIdentity := nocfg.PrivateKey == nil && p.Passphrase == "" &&
+		p.KeyIn == "" && p.IdentityPath != ""
+	if len(p.ClientAuthPubKeys) != 0 {
+		if err := checkClientAuthKey(nocfg.PrivateKey, p.KeyType); err != nil {
+			return nil, err
+		}
+	}
+	if p.ClientAuthNew > 0 && isV2Key(nocfg.PrivateKey, p.KeyType) {
+		// v2 clients are authorized by cookies made by tor
+		clients = nil
+		nocfg.ClientAuthV3 = nil
+		nocfg.BasicAuth = true
+		nocfg.ClientAuth = v2ClientNames(p.ClientAuthNew)
+	}
+	// Publishing onion again requires the key
+	keepKey := p.ExportKeyPath != "" || p.KeyOut != nil || newIdentity || p.ReconnectTor
+	// Tor picks the best key type itself
+	if nocfg.PrivateKey == nil && (keepKey || p.KeyType == KeyTypeRSA1024) {
+		nocfg.PrivateKey, err = onionutil.GenerateOnionKey(rand.Reader, version)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to generate onion key: %v", err)
+		}
+	}
+	if newIdentity {
+		err := createKeyFile(p.IdentityPath, nocfg.PrivateKey, keyFormat(nocfg.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to save onion key: %v", err)
+		}
+	}
+
+	oi, err := newOnion(c, nocfg, p.OnExisting, log)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred while creating an onion service: %v", err)
+	}
+	o.ID = oi.OnionID
+	if p.ExportKeyPath != "" {
+		err := writeKeyFile(p.ExportKeyPath, nocfg.PrivateKey, KeyFormatTor)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to export onion key: %v", err)
+		}
+	}
+	if p.KeyOut != nil {
+		o.Key, err = ExportKey(nocfg.PrivateKey, keyFormat(nocfg.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to export onion key: %v", err)
+		}
+		if _, err := p.KeyOut.Write(o.Key); err != nil {
+			return nil, fmt.Errorf("Unable to export onion key: %v", err)
+		}
+	}
+	// Detached onions are meant to outlive the share
+	o.owned = !nocfg.Detach
+	for _, k := range clients {
+		o.ClientAuth = append(o.ClientAuth, k.authPrivate(oi.OnionID))
+	}
+	o.ClientAuth = append(o.ClientAuth, hidServAuth(oi)...)
+	if p.ReconnectTor && o.tor == nil {
+		o.republish = func() (*bulb.Conn, error) {
+			return republish(p, nocfg, o.ID, log)
+		}
+	}
+	return o, nil
+}
+
+// republish connects to tor at p.ControlPath again and publishes
+// onion id of nocfg there. Onion left by the previous connection
+// (e.g. a detached one) is replaced.
+func republish(p Parameters, nocfg *onionConfig, id string, log *slog.Logger) (*bulb.Conn, error) {
+	c, err := dialControl(p)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to control socket: %v", err)
+	}
+	c.Debug(p.Debug)
+	if err := authenticate(c, controlPassword(p.ControlPassword)); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Authentication failed: %v", err)
+	}
+	oi, err := newOnion(c, nocfg, OnExistingRecreate, log)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Error occurred while creating an onion service: %v", err)
+	}
+	if oi.OnionID != id {
+		c.DeleteOnion(oi.OnionID)
+		c.Close()
+		return nil, fmt.Errorf("Tor has published %s.onion instead of %s.onion", oi.OnionID, id)
+	}
+	return c, nil
+}
+
+// reconnects reports whether the onion is published again once
+// connection to tor is lost.
+func (o *onionService) reconnects() bool {
+	return o.republish != nil
+}
+
+// watch calls event (if set) for every event from tor and lost if
+// connection to tor is lost before the onion is closed. If the
+// onion reconnects, watch publishes it again, calls recovered (if
+// set) and goes on watching.
+func (o *onionService) watch(event func(*bulb.Response), lost func(error), recovered func()) {
+	for {
+		o.mu.Lock()
+		c := o.control
+		o.mu.Unlock()
+		resp, err := c.NextEvent()
+		if err == nil {
+			if event != nil {
+				event(resp)
+			}
+			continue
+		}
+		o.mu.Lock()
+		closed := o.closed
+		if !closed {
+			o.err = err
+		}
+		o.mu.Unlock()
+		// Otherwise close has closed the connection
+		if closed {
+			return
+		}
+		lost(err)
+		if !o.reconnects() || !o.reconnect() {
+			return
+		}
+		if recovered != nil {
+			recovered()
+		}
+	}
+}
+
+// reconnect publishes the onion again, retrying with growing delays
+// until it succeeds or the onion is closed.
+func (o *onionService) reconnect() bool {
+	delay := time.Second
+	for {
+		select {
+		case <-o.closing:
+			return false
+		case <-time.After(delay):
+		}
+		c, err := o.republish()
+		if err != nil {
+			o.log.Debug("Unable to publish onion again", "onion", o.ID, "err", err, "retry", delay)
+			delay = min(2*delay, maxReconnectDelay)
+			continue
+		}
+		o.mu.Lock()
+		closed := o.closed
+		if !closed {
+			o.control = c
+			o.err = nil
+		}
+		o.mu.Unlock()
+		if closed {
+			if o.owned {
+				c.DeleteOnion(o.ID)
+			}
+			c.Close()
+			return false
+		}
+		o.log.Info("Onion is published again", "onion", o.ID)
+		return true
+	}
+}
+
+// lost returns the error connection to tor was lost with, if it
+// was.
+func (o *onionService) lost() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+// close deletes the onion service unless tor is gone, disconnects
+// from tor and stops it if it's ours. It returns the error
+// connection to tor was lost with, if it was.
+func (o *onionService) close() error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	err := o.err
+	c := o.control
+	if !o.closed {
+		o.closed = true
+		close(o.closing)
+	}
+	o.mu.Unlock()
+	if o.owned && err == nil {
+		c.DeleteOnion(o.ID)
+	}
+	c.Close()
+	o.tor.stop()
+	return err
+}
@@ -0,0 +1,21 @@
+// qr.go - QR codes of links.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"rsc.io/qr"
+)
+
+// QR returns PNG image of QR code of the link.
+func (l ResultLink) QR() ([]byte, error) {
+	code, err := qr.Encode(l.URL.String(), qr.L)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
@@ -0,0 +1,319 @@
+// ratelimit.go - shape response throughput and limit requests.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RampUp is a per-response rate limit which starts at Initial bytes
+// per second and grows by Step bytes per second every Interval.
+// It is experimental and meant to make the beginning of transfers
+// look less bursty.
+type RampUp struct {
+	Initial  int64
+	Step     int64
+	Interval time.Duration
+}
+
+// rate returns the rate limit after elapsed time.
+func (r RampUp) rate(elapsed time.Duration) float64 {
+	k := float64(elapsed / r.Interval)
+	return float64(r.Initial) + float64(r.Step)*k
+}
+
+// allowance returns the number of bytes allowed to be sent
+// during elapsed time.
+func (r RampUp) allowance(elapsed time.Duration) float64 {
+	// Count in floats, as integers overflow on long transfers
+	// with short intervals
+	k := float64(elapsed / r.Interval)
+	interval := r.Interval.Seconds()
+	rest := (elapsed % r.Interval).Seconds()
+	whole := interval * (float64(r.Initial)*k + float64(r.Step)*k*(k-1)/2)
+	return whole + rest*r.rate(elapsed)
+}
+
+const rampChunkSize = 4096
+
+type rampWriter struct {
+	http.ResponseWriter
+	ramp  RampUp
+	start time.Time
+	sent  int64
+}
+
+// wait blocks until n more bytes are allowed to be sent.
+func (w *rampWriter) wait(n int) {
+	for {
+		elapsed := time.Since(w.start)
+		excess := float64(w.sent+int64(n)) - w.ramp.allowance(elapsed)
+		if excess <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(excess / w.ramp.rate(elapsed) * float64(time.Second)))
+	}
+}
+
+func (w *rampWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > rampChunkSize {
+			chunk = chunk[:rampChunkSize]
+		}
+		w.wait(len(chunk))
+		n, err := w.ResponseWriter.Write(chunk)
+		w.sent += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *rampWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rampHandler limits rate of responses of h according to ramp.
+func rampHandler(h http.Handler, ramp RampUp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw := &rampWriter{
+			ResponseWriter: w,
+			ramp:           ramp,
+			start:          time.Now(),
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// byteLimiter limits total rate of responses with a token bucket
+// of bytes shared by all of them.
+type byteLimiter struct {
+	rate   float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: float64(rate)}
+}
+
+// burst is the size of token bucket.
+func (bl *byteLimiter) burst() float64 {
+	if bl.rate/10 < rampChunkSize {
+		return rampChunkSize
+	}
+	return bl.rate / 10
+}
+
+// take waits until n more bytes are allowed to be sent. Tokens are
+// taken in advance, so concurrent writers queue up.
+func (bl *byteLimiter) take(n int) {
+	bl.mu.Lock()
+	now := time.Now()
+	if bl.last.IsZero() {
+		bl.tokens = bl.burst()
+	} else {
+		bl.tokens += now.Sub(bl.last).Seconds() * bl.rate
+		if bl.tokens > bl.burst() {
+			bl.tokens = bl.burst()
+		}
+	}
+	bl.last = now
+	bl.tokens -= float64(n)
+	var d time.Duration
+	if bl.tokens < 0 {
+		d = time.Duration(-bl.tokens / bl.rate * float64(time.Second))
+	}
+	bl.mu.Unlock()
+	time.Sleep(d)
+}
+
+type limitedWriter struct {
+	http.ResponseWriter
+	bl *byteLimiter
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > rampChunkSize {
+			chunk = chunk[:rampChunkSize]
+		}
+		w.bl.take(len(chunk))
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *limitedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// handler limits rate of responses of h.
+func (bl *byteLimiter) handler(h http.Handler) http.Handler {
+	if bl == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&limitedWriter{w, bl}, req)
+	})
+}
+
+// Timeouts of connections of shares with MaxConns. Tor adds
+// seconds of latency, so they are generous.
+var (
+	maxConnsHeaderTimeout = 30 * time.Second
+	maxConnsIdleTimeout   = 15 * time.Second
+)
+
+// connLimitListener accepts at most cap(sem) connections at once.
+// Accept blocks until one of them is closed.
+type connLimitListener struct {
+	net.Listener
+	sem    chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnLimitListener(l net.Listener, n int) *connLimitListener {
+	return &connLimitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitedConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *connLimitListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitedConn releases its slot of connLimitListener on Close.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// requestLimiter limits number of requests in flight and rate
+// of incoming requests (with token bucket of RateLimit tokens).
+type requestLimiter struct {
+	inflight chan struct{}
+	rate     float64
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+}
+
+func newRequestLimiter(maxConcurrent int, rate float64) *requestLimiter {
+	if maxConcurrent <= 0 && rate <= 0 {
+		return nil
+	}
+	rl := &requestLimiter{rate: rate}
+	if maxConcurrent > 0 {
+		rl.inflight = make(chan struct{}, maxConcurrent)
+	}
+	return rl
+}
+
+// burst is the size of token bucket.
+func (rl *requestLimiter) burst() float64 {
+	if rl.rate < 1 {
+		return 1
+	}
+	return rl.rate
+}
+
+// allow takes a token from the bucket if there is one.
+func (rl *requestLimiter) allow() bool {
+	if rl.rate <= 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if rl.last.IsZero() {
+		rl.tokens = rl.burst()
+	} else {
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.burst() {
+			rl.tokens = rl.burst()
+		}
+	}
+	rl.last = now
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// handler responds with 503 to requests to h over the limits.
+func (rl *requestLimiter) handler(h http.Handler) http.Handler {
+	if rl == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !rl.allow() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusServiceUnavailable)
+			return
+		}
+		if rl.inflight != nil {
+			select {
+			case rl.inflight <- struct{}{}:
+				defer func() { <-rl.inflight }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,132 @@
+package onionize
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// timedWriter records when bytes are written.
+type timedWriter struct {
+	http.ResponseWriter
+	mu     sync.Mutex
+	start  time.Time
+	writes []timedWrite
+}
+
+type timedWrite struct {
+	at time.Duration
+	n  int
+}
+
+func (w *timedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	w.writes = append(w.writes, timedWrite{time.Since(w.start), len(b)})
+	w.mu.Unlock()
+	return w.ResponseWriter.Write(b)
+}
+
+// written returns number of bytes written during [from, to).
+func (w *timedWriter) written(from, to time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var n int
+	for _, tw := range w.writes {
+		if tw.at >= from && tw.at < to {
+			n += tw.n
+		}
+	}
+	return n
+}
+
+func TestRampUpRateGrows(t *testing.T) {
+	ramp := RampUp{Initial: 100000, Step: 100000, Interval: 100 * time.Millisecond}
+	const size = 150000 // 5 intervals
+	h := rampHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(make([]byte, size))
+	}), ramp)
+	tw := &timedWriter{ResponseWriter: httptest.NewRecorder(), start: time.Now()}
+	h.ServeHTTP(tw, httptest.NewRequest("GET", "/", nil))
+	elapsed := time.Since(tw.start)
+	if elapsed < 350*time.Millisecond {
+		t.Fatalf("%d bytes are sent in %v, faster than the ramp allows", size, elapsed)
+	}
+	first := tw.written(0, 100*time.Millisecond)
+	fourth := tw.written(300*time.Millisecond, 400*time.Millisecond)
+	if fourth < 2*first {
+		t.Fatalf("%d bytes are sent in the 4th interval, %d in the 1st", fourth, first)
+	}
+}
+
+func TestRampUpAllowanceLong(t *testing.T) {
+	ramp := RampUp{Initial: 1 << 20, Step: 1 << 30, Interval: time.Millisecond}
+	prev := 0.0
+	for _, elapsed := range []time.Duration{time.Second, time.Hour, 24 * time.Hour, 365 * 24 * time.Hour} {
+		a := ramp.allowance(elapsed)
+		if a <= prev {
+			t.Fatalf("allowance after %v is %g, after shorter time %g", elapsed, a, prev)
+		}
+		prev = a
+	}
+}
+
+func TestRateWritersUnwrap(t *testing.T) {
+	for name, h := range map[string]http.Handler{
+		"ramp": rampHandler(http.HandlerFunc(flushHandler), RampUp{Initial: 1 << 20, Interval: time.Second}),
+		"max":  newByteLimiter(1 << 20).handler(http.HandlerFunc(flushHandler)),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK || !w.Flushed {
+			t.Errorf("%s: flush through the writer fails: %d %q", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func flushHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("x"))
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func TestMaxConnsIdle(t *testing.T) {
+	defer func(idle time.Duration) { maxConnsIdleTimeout = idle }(maxConnsIdleTimeout)
+	maxConnsIdleTimeout = 100 * time.Millisecond
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "f.txt"), "f")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New(ctx, Parameters{Pathspec: filepath.Join(dir, "f.txt"), Listener: l, MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	u := "http://" + l.Addr().String() + "/f.txt"
+	// Keeps its connection open while idle
+	idle := &http.Client{Transport: &http.Transport{}}
+	resp, err := idle.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	other := &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second}
+	resp, err = other.Get(u)
+	if err != nil {
+		t.Fatalf("idle connection holds the only slot: %v", err)
+	}
+	resp.Body.Close()
+	cancel()
+	<-s.Done()
+}
@@ -0,0 +1,87 @@
+package onionize
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// snapshot describes every entry under root with its mode, size
+// and modification time.
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		m[p] = fmt.Sprintf("%v %d %v", fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestServeReadOnly(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "share")
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "dir", "b.txt"), "b")
+	writeFile(t, filepath.Join(root, "single", "only.txt"), "only")
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if d.IsDir() {
+			return os.Chmod(p, 0555)
+		}
+		return os.Chmod(p, 0444)
+	})
+	t.Cleanup(func() {
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			return os.Chmod(p, 0755)
+		})
+	})
+	// Permissions don't stop root, so changes are looked for too
+	before := snapshot(t, root)
+
+	for _, p := range []Parameters{
+		{Paths: []string{root}, CacheListings: true, Digests: true, ZipDownloads: true},
+		{Paths: []string{root}, MaskModTimes: true},
+		{Paths: []string{filepath.Join(root, "single", "only.txt")}, LandingPage: true, Digests: true, ForceDownload: true},
+	} {
+		fs := newTestFileServer(t, p)
+		for _, target := range []string{
+			"/", "/share/", "/share/a.txt", "/share/dir/", "/share/dir/b.txt",
+			"/share/?download=zip", "/share/dir/?download=zip", "/only.txt", "/missing",
+		} {
+			get(fs, target)
+			req := httptest.NewRequest("HEAD", target, nil)
+			fs.ServeHTTP(httptest.NewRecorder(), req)
+			req = httptest.NewRequest("GET", target, nil)
+			req.Header.Set("Range", "bytes=0-0")
+			fs.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		if w := get(fs, "/share/dir/b.txt"); p.Paths[0] == root && (w.Code != http.StatusOK || w.Body.String() != "b") {
+			t.Fatalf("read-only file: %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	after := snapshot(t, root)
+	for p, s := range after {
+		if before[p] != s {
+			t.Errorf("%s changed: %q, was %q", p, s, before[p])
+		}
+	}
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			t.Errorf("%s is gone", p)
+		}
+	}
+}
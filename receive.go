@@ -0,0 +1,207 @@
+// receive.go - receive files uploaded by clients.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest file name most filesystems allow.
+const maxFilenameLength = 255
+
+const uploadForm = `<!doctype html>
+<meta name="viewport" content="width=device-width">
+<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple>
+<input type="submit" value="Upload">
+</form>
+`
+
+// sanitizeFilename turns name sent by a client into a name of
+// a file inside the receiving directory: no directories, no
+// control characters and no hidden files.
+func sanitizeFilename(name string) string {
+	// Some clients send full Windows paths
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = truncate(strings.TrimLeft(strings.TrimSpace(name), "."), maxFilenameLength)
+	if name == "" || name == "/" {
+		name = "upload"
+	}
+	return name
+}
+
+// truncate cuts s to at most n bytes without splitting runes.
+func truncate(s string, n int) string {
+	for len(s) > max(n, 0) {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// receiver accepts multipart uploads via POST and writes them
+// into dir.
+type receiver struct {
+	dir     string
+	maxSize int64
+	log     *slog.Logger
+	emit    func(Event)
+}
+
+func newReceiver(p Parameters, emit func(Event)) (*receiver, error) {
+	fi, err := os.Stat(p.ReceiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to use receiving directory: %v", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", p.ReceiveDir)
+	}
+	return &receiver{
+		dir:     p.ReceiveDir,
+		maxSize: p.MaxUploadSize,
+		log:     logger(p),
+		emit:    emit,
+	}, nil
+}
+
+// create creates a new file for name without touching existing
+// files.
+func (rv *receiver) create(name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	if len(ext) > maxFilenameLength/2 {
+		// It's hardly an extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		if i != 0 {
+			suffix := fmt.Sprintf(" (%d)%s", i, ext)
+			name = truncate(base, maxFilenameLength-len(suffix)) + suffix
+		}
+		f, err := os.OpenFile(filepath.Join(rv.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, name, err
+	}
+}
+
+// progressWriter emits UploadProgress for every write.
+type progressWriter struct {
+	w       io.Writer
+	name    string
+	written int64
+	emit    func(Event)
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.written += int64(n)
+	pw.emit(UploadProgress{Name: pw.name, Bytes: pw.written})
+	return n, err
+}
+
+// receive writes part into a new file and returns its name.
+func (rv *receiver) receive(part io.Reader, filename string) (string, error) {
+	f, name, err := rv.create(sanitizeFilename(filename))
+	if err != nil {
+		return "", err
+	}
+	pw := &progressWriter{w: f, name: name, emit: rv.emit}
+	_, err = io.Copy(pw, part)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	rv.emit(FileReceived{Name: name, Bytes: pw.written})
+	return name, nil
+}
+
+func (rv *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, uploadForm)
+		return
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rv.maxSize > 0 {
+		// Reject before reading the body, so clients waiting for
+		// 100 Continue don't send it at all
+		if req.ContentLength > rv.maxSize {
+			http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, rv.maxSize)
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart upload", http.StatusBadRequest)
+		return
+	}
+	var received []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && part.FileName() == "" {
+			continue
+		}
+		var name string
+		if err == nil {
+			name, err = rv.receive(part, part.FileName())
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			rv.log.Error("Unable to receive upload", "err", err)
+			http.Error(w, "Unable to receive upload", http.StatusInternalServerError)
+			return
+		}
+		rv.log.Debug("Received", "name", name, "remote", req.RemoteAddr)
+		received = append(received, name)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+	fmt.Fprintf(w, "Received %d file(s):\n", len(received))
+	for _, name := range received {
+		fmt.Fprintf(w, "%s\n", html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
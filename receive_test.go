@@ -0,0 +1,182 @@
+package onionize
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":                "report.pdf",
+		"../../etc/passwd":          "passwd",
+		`C:\Users\me\Desktop\a.txt`: "a.txt",
+		".hidden":                   "hidden",
+		"  spaced  ":                "spaced",
+		"bell\a.txt":                "bell.txt",
+		"":                          "upload",
+		"..":                        "upload",
+		"/":                         "upload",
+		"отчёт.txt":                 "отчёт.txt",
+		strings.Repeat("a", 300):    strings.Repeat("a", maxFilenameLength),
+	} {
+		if got := sanitizeFilename(name); got != want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+	for _, r := range []string{"é", "ж", "€", "😀"} {
+		got := sanitizeFilename(strings.Repeat(r, 200))
+		if len(got) > maxFilenameLength || !utf8.ValidString(got) {
+			t.Errorf("long name of %q is sanitized into %d bytes, valid UTF-8: %v", r, len(got), utf8.ValidString(got))
+		}
+		if len(got)+len(r) <= maxFilenameLength {
+			t.Errorf("long name of %q is truncated too much: %d bytes", r, len(got))
+		}
+	}
+}
+
+func newTestReceiver(t *testing.T, maxSize int64) (*receiver, string) {
+	t.Helper()
+	dir := t.TempDir()
+	rv, err := newReceiver(Parameters{
+		ReceiveDir:    dir,
+		MaxUploadSize: maxSize,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, func(Event) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv, dir
+}
+
+// multipartBody returns multipart body with files and its content
+// type.
+func multipartBody(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for name, content := range files {
+		w, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	mw.Close()
+	return &b, mw.FormDataContentType()
+}
+
+func upload(rv http.Handler, body io.Reader, ctype string, length int64) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", ctype)
+	req.ContentLength = length
+	w := httptest.NewRecorder()
+	rv.ServeHTTP(w, req)
+	return w
+}
+
+func TestReceive(t *testing.T) {
+	rv, dir := newTestReceiver(t, 0)
+	for i := 0; i < 2; i++ {
+		body, ctype := multipartBody(t, map[string]string{"../notes.txt": "notes"})
+		if w := upload(rv, body, ctype, int64(body.Len())); w.Code != http.StatusOK {
+			t.Fatalf("upload: %d %q", w.Code, w.Body.String())
+		}
+	}
+	for _, name := range []string{"notes.txt", "notes (1).txt"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != "notes" {
+			t.Errorf("%s: %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestReceiveLongNames(t *testing.T) {
+	rv, dir := newTestReceiver(t, 0)
+	for _, name := range []string{
+		strings.Repeat("a", maxFilenameLength-4) + ".txt",
+		strings.Repeat("ж", maxFilenameLength/2) + ".txt",
+		"a." + strings.Repeat("b", maxFilenameLength-2),
+	} {
+		for i := 0; i < 3; i++ {
+			body, ctype := multipartBody(t, map[string]string{name: "x"})
+			if w := upload(rv, body, ctype, int64(body.Len())); w.Code != http.StatusOK {
+				t.Fatalf("upload %d of %d bytes long name: %d %q", i, len(name), w.Code, w.Body.String())
+			}
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 9 {
+		t.Errorf("%d files are received, want 9", len(entries))
+	}
+	for _, e := range entries {
+		if len(e.Name()) > maxFilenameLength || !utf8.ValidString(e.Name()) {
+			t.Errorf("%q is %d bytes long, valid UTF-8: %v", e.Name(), len(e.Name()), utf8.ValidString(e.Name()))
+		}
+	}
+}
+
+func TestReceiveTooLarge(t *testing.T) {
+	rv, dir := newTestReceiver(t, 100)
+	body, ctype := multipartBody(t, map[string]string{"big.bin": strings.Repeat("x", 1000)})
+	// Size is unknown beforehand (e.g. chunked)
+	if w := upload(rv, body, ctype, -1); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized upload: %d", w.Code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("oversized upload is left behind: %v", entries)
+	}
+}
+
+// expectContinue sends to h headers of a large upload waiting for
+// 100 Continue and returns the response it gets without sending the
+// body.
+func expectContinue(t *testing.T, h http.Handler, header string) *http.Response {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: x\r\n"+
+		"Content-Type: multipart/form-data; boundary=x\r\n%s"+
+		"Content-Length: 1000000\r\nExpect: 100-continue\r\n\r\n", header)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response before the body is sent: %v", err)
+	}
+	return resp
+}
+
+func TestReceiveRejectedEarly(t *testing.T) {
+	rv, _ := newTestReceiver(t, 100)
+	if resp := expectContinue(t, rv, ""); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload: got %s, want 413 without 100 Continue", resp.Status)
+	}
+	rv, _ = newTestReceiver(t, 0)
+	h := basicAuthHandler(rv, "user", "password", nil)
+	if resp := expectContinue(t, h, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("upload without credentials: got %s, want 401 without 100 Continue", resp.Status)
+	}
+	if resp := expectContinue(t, h, "Authorization: Basic dXNlcjp3cm9uZw==\r\n"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("upload with wrong credentials: got %s, want 401 without 100 Continue", resp.Status)
+	}
+}
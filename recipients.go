@@ -0,0 +1,130 @@
+// recipients.go - links of their own for recipients of a share.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// Recipient is a recipient of the share with a link of their own.
+type Recipient struct {
+	Name string
+	URL  url.URL
+}
+
+type recipientSlug struct {
+	name string
+	slug string
+}
+
+// slugRegistry holds slugs the share is reachable with: the slug
+// of the share link and slugs of recipients, which can be added
+// and revoked while the share is up.
+type slugRegistry struct {
+	mu         sync.RWMutex
+	main       string
+	recipients []recipientSlug
+	// length of recipient slugs
+	length int
+}
+
+func newSlugRegistry(main string, length int) *slugRegistry {
+	if length <= 0 || length > maxSlugLength {
+		length = defaultSlugLength
+	}
+	return &slugRegistry{main: main, length: length}
+}
+
+// match reports whether slug is one of the registered ones. Every
+// slug is compared in constant time.
+func (sr *slugRegistry) match(slug string) bool {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	ok := subtle.ConstantTimeCompare([]byte(sr.main), []byte(slug))
+	for _, r := range sr.recipients {
+		ok |= subtle.ConstantTimeCompare([]byte(r.slug), []byte(slug))
+	}
+	return ok == 1
+}
+
+func (sr *slugRegistry) add(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("Recipient must have a name")
+	}
+	if sr.main == "" {
+		return "", errors.New("Recipients require slugs")
+	}
+	slug, err := generateSlug(sr.length)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate slug: %v", err)
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for _, r := range sr.recipients {
+		if r.name == name {
+			return "", fmt.Errorf("Recipient %q already exists", name)
+		}
+	}
+	sr.recipients = append(sr.recipients, recipientSlug{name: name, slug: slug})
+	return slug, nil
+}
+
+func (sr *slugRegistry) revoke(name string) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for i, r := range sr.recipients {
+		if r.name == name {
+			sr.recipients = append(sr.recipients[:i], sr.recipients[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No such recipient: %q", name)
+}
+
+func (sr *slugRegistry) list() []recipientSlug {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return append([]recipientSlug(nil), sr.recipients...)
+}
+
+// recipientLink returns link of the share with slug.
+func (s *Service) recipientLink(slug string) url.URL {
+	link := s.Link
+	link.Host = slug + "." + s.onionHost
+	return link
+}
+
+// AddRecipient makes a link of its own for recipient name. It can
+// be revoked with RevokeRecipient without affecting other links.
+func (s *Service) AddRecipient(name string) (url.URL, error) {
+	slug, err := s.slugs.add(name)
+	if err != nil {
+		return url.URL{}, err
+	}
+	return s.recipientLink(slug), nil
+}
+
+// RevokeRecipient makes the link of recipient name stop working.
+// Requests already made with it are let to complete.
+func (s *Service) RevokeRecipient(name string) error {
+	return s.slugs.revoke(name)
+}
+
+// Recipients returns recipients of the share along with their links
+// in order they were added.
+func (s *Service) Recipients() []Recipient {
+	var rs []Recipient
+	for _, r := range s.slugs.list() {
+		rs = append(rs, Recipient{Name: r.name, URL: s.recipientLink(r.slug)})
+	}
+	return rs
+}
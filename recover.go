@@ -0,0 +1,37 @@
+// recover.go - survive panics in handlers.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// recoverHandler turns panics in h into 500 responses. If the
+// response is already underway, it's aborted instead so the client
+// doesn't take it for a complete one.
+func recoverHandler(h http.Handler, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Error("Panic while serving", "path", req.URL.Path, "panic", v)
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(sw, req)
+	})
+}
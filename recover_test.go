@@ -0,0 +1,84 @@
+package onionize
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+// panicFS panics on opening "boom".
+type panicFS struct {
+	fs.FS
+}
+
+func (f panicFS) Open(name string) (fs.File, error) {
+	if name == "boom" {
+		panic("boom")
+	}
+	return f.FS.Open(name)
+}
+
+func TestRecoverPanickingHook(t *testing.T) {
+	fsys := panicFS{fstest.MapFS{
+		"boom": &fstest.MapFile{Data: []byte("boom")},
+		"ok":   &fstest.MapFile{Data: []byte("ok")},
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New(ctx, Parameters{FS: fsys, Listener: l, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	base := "http://" + l.Addr().String()
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(base + "/boom")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("panicking request: %d", resp.StatusCode)
+		}
+		resp, err = http.Get(base + "/ok")
+		if err != nil {
+			t.Fatalf("serving stopped after panic: %v", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Fatalf("after panic: %d %q", resp.StatusCode, b)
+		}
+	}
+	cancel()
+	<-s.Done()
+}
+
+func TestRecoverAfterWrite(t *testing.T) {
+	h := recoverHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("partial"))
+		panic("in the middle")
+	}), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	w := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("response is not aborted: %v", v)
+			}
+		}()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	}()
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Fatalf("error is written over the response: %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,102 @@
+// selfsigned.go - self-signed TLS certificates for shares.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	maxSelfSignedCerts = 64
+)
+
+// selfSigned issues self-signed certificates for names the clients
+// ask for. Names aren't known before the onion is published, so
+// certificates are made on the first handshake. Clients without
+// a name and those beyond maxSelfSignedCerts names get fallback,
+// made once along with the key.
+type selfSigned struct {
+	key      *ecdsa.PrivateKey
+	mu       sync.Mutex
+	certs    map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// SelfSignedTLSConfig returns TLS config which presents a
+// self-signed certificate for whatever name (e.g. onion address
+// with slug) the client asks for. Browsers warn about such
+// certificates, but once accepted the share is a secure context.
+func SelfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate TLS key: %v", err)
+	}
+	ss := &selfSigned{key: key, certs: make(map[string]*tls.Certificate)}
+	if ss.fallback, err = ss.issue("onionize"); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: ss.certificate}, nil
+}
+
+func (ss *selfSigned) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		return ss.fallback, nil
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if cert, ok := ss.certs[name]; ok {
+		return cert, nil
+	}
+	// Names are up to clients, so don't let them fill memory or
+	// make us sign certificates all the time
+	if len(ss.certs) >= maxSelfSignedCerts {
+		return ss.fallback, nil
+	}
+	cert, err := ss.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	ss.certs[name] = cert
+	return cert, nil
+}
+
+// issue makes a certificate for name.
+func (ss *selfSigned) issue(name string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		// Don't tell when the share was started
+		NotBefore:             now.Add(-24 * time.Hour).Truncate(24 * time.Hour),
+		NotAfter:              now.Add(selfSignedValidity).Truncate(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ss.key.PublicKey, ss.key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create TLS certificate: %v", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: ss.key}, nil
+}
@@ -0,0 +1,37 @@
+package onionize
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+)
+
+func TestSelfSignedCap(t *testing.T) {
+	cfg, err := SelfSignedTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := func(name string) *tls.Certificate {
+		c, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	fallback := cert("")
+	first := cert("a.onion")
+	if first == fallback || cert("a.onion") != first {
+		t.Fatal("certificate of a name is not issued once")
+	}
+	for i := 0; i < maxSelfSignedCerts; i++ {
+		cert(fmt.Sprintf("%d.onion", i))
+	}
+	for i := 0; i < 10; i++ {
+		if cert(fmt.Sprintf("new-%d.onion", i)) != fallback {
+			t.Fatal("certificate is issued beyond the limit")
+		}
+	}
+	if cert("a.onion") != first {
+		t.Fatal("certificate of a known name is dropped")
+	}
+}
@@ -0,0 +1,69 @@
+// sensitive.go - look for files one probably doesn't want to share.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// DefaultSensitivePatterns are file name patterns (as in path.Match)
+// of files that are likely to be shared by mistake.
+var DefaultSensitivePatterns = []string{
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519",
+	"*.pem", "*.key", "*.p12", "*.pfx", "*.kdbx",
+	".env", ".netrc", ".htpasswd", ".git-credentials",
+	"hs_ed25519_secret_key", "private_key",
+}
+
+// findSensitiveFiles returns descriptions of files in fsys whose
+// names match any of patterns or whose permissions allow access to
+// the owner only.
+func findSensitiveFiles(fsys vfs.FileSystem, patterns []string) ([]string, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid sensitive file pattern %q: %v", pattern, err)
+		}
+	}
+	var found []string
+	err := walkFS(fsys, "/", func(p string, fi os.FileInfo) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, fi.Name()); ok {
+				found = append(found, fmt.Sprintf("%s (matches %q)", p, pattern))
+				return
+			}
+		}
+		if perm := fi.Mode().Perm(); perm&0077 == 0 && perm != 0 {
+			found = append(found, fmt.Sprintf("%s (has permissions %v)", p, perm))
+		}
+	})
+	return found, err
+}
+
+// checkSensitiveFiles reports sensitive files of fsys, the files of
+// share p, and fails if p refuses to share them.
+func checkSensitiveFiles(fsys vfs.FileSystem, p Parameters) error {
+	patterns := p.SensitivePatterns
+	if patterns == nil {
+		patterns = DefaultSensitivePatterns
+	}
+	found, err := findSensitiveFiles(fsys, patterns)
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		logger(p).Warn("Sensitive file is being shared", "file", f)
+	}
+	if p.RefuseSensitiveFiles && len(found) != 0 {
+		return fmt.Errorf("Refusing to share %d sensitive file(s)", len(found))
+	}
+	return nil
+}
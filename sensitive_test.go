@@ -0,0 +1,66 @@
+package onionize
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRefuseSensitiveFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "share")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "notes")
+	writeFile(t, filepath.Join(dir, "keys", "id_ed25519"), "secret")
+	for _, tc := range []struct {
+		name string
+		p    Parameters
+	}{
+		{"directory", Parameters{Pathspec: dir}},
+		{"paths", Parameters{Paths: []string{dir}}},
+		{"zipdir", Parameters{Pathspec: dir, ZipDir: true}},
+		{"webdav", Parameters{Pathspec: dir, WebDAV: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.p
+			p.NoOnion = true
+			p.RefuseSensitiveFiles = true
+			s, err := CreateOnion(p)
+			if err == nil {
+				s.Close()
+				t.Fatal("sensitive file is shared")
+			}
+			if !strings.Contains(err.Error(), "Refusing") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+	t.Run("separate", func(t *testing.T) {
+		ft := newFake(t)
+		p := Parameters{
+			Paths:                []string{filepath.Join(dir, "notes.txt"), filepath.Join(dir, "keys")},
+			SeparateOnions:       true,
+			RefuseSensitiveFiles: true,
+			DialControl:          ft.Dial,
+		}
+		err := Onionize(context.Background(), p, make(chan ResultLink, 2))
+		if err == nil || !strings.Contains(err.Error(), "Refusing") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if onions := ft.Onions(); len(onions) != 0 {
+			t.Fatalf("onions are left: %v", onions)
+		}
+	})
+	t.Run("text", func(t *testing.T) {
+		s, err := CreateOnion(Parameters{Text: "hi", NoOnion: true, WarnSensitiveFiles: true})
+		if err == nil {
+			s.Close()
+			t.Fatal("sensitive files are looked for in text")
+		}
+	})
+	p := Parameters{Pathspec: filepath.Join(dir, "notes.txt"), NoOnion: true, RefuseSensitiveFiles: true}
+	s, err := CreateOnion(p)
+	if err != nil {
+		t.Fatalf("harmless file is refused: %v", err)
+	}
+	s.Close()
+}
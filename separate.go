@@ -0,0 +1,104 @@
+// separate.go - share paths via separate onion services.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"context"
+	"errors"
+)
+
+// separateShares splits p into parameters of a share per path
+// (with its alias, if any).
+func separateShares(p Parameters) ([]Parameters, error) {
+	switch {
+	case p.Passphrase != "" || p.IdentityKey != nil || p.KeyIn != "" ||
+		p.IdentityPath != "" || p.ExportKeyPath != "" || p.KeyOut != nil:
+		return nil, errors.New("Separate onions can't share an onion key")
+	case p.SlugValue != "":
+		return nil, errors.New("Separate onions can't share a slug")
+	case p.MetricsAddr != "":
+		return nil, errors.New("Separate onions can't share a metrics address")
+	case p.Listener != nil || p.NoOnion:
+		return nil, errors.New("Separate onions require onion services")
+	case p.ReceiveDir != "" || p.WebDAV || p.FS != nil || p.FileSystem != nil || p.Zip ||
+		p.Content != nil || p.Text != "":
+		return nil, errors.New("Only paths can be shared via separate onions")
+	}
+	var paths []string
+	if len(p.Paths) != 0 {
+		paths = p.Paths
+	} else {
+		paths = splitQuoted(p.Pathspec, '"', delimeter)
+	}
+	shares := make([]Parameters, len(paths))
+	for i, path := range paths {
+		q := p
+		q.SeparateOnions = false
+		if len(p.Paths) != 0 {
+			q.Paths = []string{path}
+		} else {
+			q.Pathspec = path
+		}
+		shares[i] = q
+	}
+	return shares, nil
+}
+
+// onionizeSeparately is Onionize for p.SeparateOnions. A failure of
+// any share stops all of them.
+func onionizeSeparately(ctx context.Context, p Parameters, linkChan chan<- ResultLink) error {
+	shares, err := separateShares(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var services []*Service
+	stopAll := func() {
+		cancel()
+		for _, s := range services {
+			<-s.Done()
+		}
+	}
+	for _, q := range shares {
+		s, err := New(ctx, q)
+		if err != nil {
+			stopAll()
+			return err
+		}
+		services = append(services, s)
+	}
+	for i, s := range services {
+		path := shares[i].Pathspec
+		if len(p.Paths) != 0 {
+			path = p.Paths[i]
+		}
+		select {
+		case linkChan <- ResultLink{URL: s.Link, ClientAuth: s.ClientAuth, Path: path, Recipients: s.Recipients()}:
+		case <-ctx.Done():
+			stopAll()
+			return ctx.Err()
+		}
+	}
+	errs := make(chan error, len(services))
+	for _, s := range services {
+		s.Start()
+		go func(s *Service) {
+			<-s.Done()
+			errs <- s.Err()
+		}(s)
+	}
+	var firstErr error
+	for range services {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,36 @@
+package onionize
+
+import (
+	"testing"
+)
+
+func TestSeparateSharesConflicts(t *testing.T) {
+	for name, p := range map[string]Parameters{
+		"passphrase": {Passphrase: "x"},
+		"slug":       {SlugValue: "abc"},
+		"listener":   {NoOnion: true},
+		"text":       {Text: "hi"},
+		"metrics":    {MetricsAddr: "127.0.0.1:9100"},
+	} {
+		p.Paths = []string{"a", "b"}
+		if _, err := separateShares(p); err == nil {
+			t.Errorf("%s: separate shares are made", name)
+		}
+	}
+	shares, err := separateShares(Parameters{Paths: []string{"a", "b"}})
+	if err != nil || len(shares) != 2 {
+		t.Fatalf("%d shares, %v", len(shares), err)
+	}
+}
+
+func TestCreateOnionOnionizeOnly(t *testing.T) {
+	for name, p := range map[string]Parameters{
+		"separate": {Paths: []string{"a", "b"}, SeparateOnions: true},
+		"forwards": {Forwards: []PortForward{{VirtPort: 22, Target: "127.0.0.1:22"}}},
+	} {
+		p.NoOnion = true
+		if _, err := CreateOnion(p); err == nil {
+			t.Errorf("%s: share is created", name)
+		}
+	}
+}
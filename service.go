@@ -0,0 +1,185 @@
+// service.go - run a created share.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ttlGracePeriod is how long requests in progress are given to
+// complete once TTL of the share is over.
+var ttlGracePeriod = time.Minute
+
+// ResultLink is the link to a share.
+type ResultLink struct {
+	URL url.URL
+	// Key is onion private key written to Parameters.KeyOut.
+	Key []byte
+	// ClientAuth are .auth_private lines with generated client
+	// keys (see Parameters.ClientAuthNew) or, for v2 onions,
+	// HidServAuth torrc lines to hand to clients.
+	ClientAuth []string
+	// Path is the path shared via the link if it is one of
+	// Parameters.SeparateOnions.
+	Path string
+	// Recipients are recipients of the share and their links.
+	Recipients []Recipient
+}
+
+// Service is a share created by CreateOnion.
+type Service struct {
+	// Link is the URL of the share.
+	Link url.URL
+	// Key is onion private key written to Parameters.KeyOut.
+	Key []byte
+	// ClientAuth are credentials of generated clients.
+	ClientAuth []string
+	server     *http.Server
+	listener   net.Listener
+	// metrics serves Parameters.MetricsAddr if set
+	metrics *http.Server
+	onion   *onionService
+	// onionHost is the host of the link without slug
+	onionHost string
+	slugs     *slugRegistry
+	ttl       time.Duration
+	expiry    *expiry
+	started   chan struct{}
+	start     sync.Once
+	// stopping is closed once the share is being stopped
+	stopping chan struct{}
+	stop     sync.Once
+	// shutdowns in progress
+	shutdowns sync.WaitGroup
+	events    chan<- Event
+	stats     stats
+	// set by New
+	stopped chan struct{}
+	err     error
+}
+
+// gate holds requests to h until the service is started. Requests
+// held when the share is stopped get 503.
+func (s *Service) gate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-s.started:
+		case <-s.stopping:
+			http.Error(w, "Share is over", http.StatusServiceUnavailable)
+			return
+		case <-req.Context().Done():
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// release lets requests held by gate go.
+func (s *Service) release() {
+	s.stop.Do(func() {
+		close(s.stopping)
+	})
+}
+
+// Start lets requests through, including the ones that came
+// before. TTL of the share counts from here.
+func (s *Service) Start() {
+	s.start.Do(func() {
+		if s.ttl > 0 {
+			s.expiry.at = time.Now().Add(s.ttl)
+			time.AfterFunc(s.ttl, func() {
+				s.shutdownWithin(ttlGracePeriod)
+			})
+		}
+		close(s.started)
+	})
+}
+
+// Serve accepts connections until the share is over or it is
+// stopped by Close or Shutdown. Connections are accepted before
+// Start, but their requests are held.
+func (s *Service) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		// Let Shutdown complete in-flight requests before
+		// tearing the onion down
+		s.shutdowns.Wait()
+		err = nil
+	}
+	if s.metrics != nil {
+		s.metrics.Close()
+	}
+	torErr := s.onion.close()
+	if torErr != nil {
+		return fmt.Errorf("Lost connection to tor: %v", torErr)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot serve HTTP: %v", err)
+	}
+	return nil
+}
+
+// Stop stops the share served by New gracefully and waits for it.
+func (s *Service) Stop() error {
+	s.Shutdown(context.Background())
+	<-s.Done()
+	return s.Err()
+}
+
+// Done returns a channel that is closed once the share served by
+// New is over.
+func (s *Service) Done() <-chan struct{} {
+	return s.stopped
+}
+
+// Err returns the error the share served by New stopped with
+// (nil if it was stopped or expired). It is valid after Done is
+// closed.
+func (s *Service) Err() error {
+	select {
+	case <-s.stopped:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close stops the share immediately. Once Serve returns, the onion
+// service is deleted and connection to tor is closed.
+func (s *Service) Close() error {
+	s.release()
+	return s.server.Close()
+}
+
+// shutdownWithin stops the share gracefully, closing requests
+// still in progress after d.
+func (s *Service) shutdownWithin(d time.Duration) {
+	s.shutdowns.Add(1)
+	defer s.shutdowns.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if s.Shutdown(ctx) != nil {
+		s.Close()
+	}
+}
+
+// Shutdown stops the share gracefully, waiting for in-flight
+// requests to complete until ctx is done. The onion service is
+// deleted afterwards as with Close.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.shutdowns.Add(1)
+	defer s.shutdowns.Done()
+	s.release()
+	return s.server.Shutdown(ctx)
+}
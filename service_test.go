@@ -0,0 +1,137 @@
+package onionize
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// blockingFS blocks reads of "slow" until release is closed.
+type blockingFS struct {
+	fstest.MapFS
+	release chan struct{}
+}
+
+type blockingFile struct {
+	vfsFile
+	release chan struct{}
+}
+
+// vfsFile is fs.File which can be served.
+type vfsFile interface {
+	fs.File
+	io.Seeker
+}
+
+func (f blockingFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil || name != "slow" {
+		return file, err
+	}
+	return blockingFile{file.(vfsFile), f.release}, nil
+}
+
+func (f blockingFile) Read(b []byte) (int, error) {
+	<-f.release
+	return f.vfsFile.Read(b)
+}
+
+func TestCancelBeforeStart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New(ctx, Parameters{Text: "hi", Listener: l, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	// Let the request be held
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("share is not stopped with a request held")
+	}
+	if code := <-status; code != http.StatusServiceUnavailable {
+		t.Fatalf("held request got %d, want 503", code)
+	}
+}
+
+func TestTTLGracePeriod(t *testing.T) {
+	defer func(d time.Duration) { ttlGracePeriod = d }(ttlGracePeriod)
+	content := strings.Repeat("slow", 1000)
+	for _, tc := range []struct {
+		name     string
+		grace    time.Duration
+		complete bool
+	}{
+		{"completed", 5 * time.Second, true},
+		{"cut off", 200 * time.Millisecond, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ttlGracePeriod = tc.grace
+			fsys := blockingFS{fstest.MapFS{"slow": &fstest.MapFile{Data: []byte(content)}}, make(chan struct{})}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(context.Background(), Parameters{
+				FS:       fsys,
+				Listener: l,
+				TTL:      100 * time.Millisecond,
+				Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Start()
+			body := make(chan string, 1)
+			go func() {
+				resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+				if err != nil {
+					body <- ""
+					return
+				}
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				body <- string(b)
+			}()
+			// Let the share expire with the download in progress
+			time.Sleep(500 * time.Millisecond)
+			if tc.complete {
+				close(fsys.release)
+			}
+			select {
+			case <-s.Done():
+			case <-time.After(10 * time.Second):
+				t.Fatal("share is not stopped")
+			}
+			if got := <-body; (got == content) != tc.complete {
+				t.Fatalf("got %d bytes, want complete: %v", len(got), tc.complete)
+			}
+			if !tc.complete {
+				close(fsys.release)
+			}
+		})
+	}
+}
@@ -7,26 +7,71 @@ import (
 	"strings"
 )
 
-func checkSlug(req *http.Request, slug string) error {
+// Slugs are the labels of hostname in front of onion address,
+// so they are limited by DNS label length.
+const maxSlugLength = 63
+
+// ValidateSlug checks that slug is a non-empty lowercase base32
+// string that fits into a hostname label.
+func ValidateSlug(slug string) error {
 	if slug == "" {
+		return fmt.Errorf("slug is empty")
+	}
+	if len(slug) > maxSlugLength {
+		return fmt.Errorf("slug is longer than %d characters", maxSlugLength)
+	}
+	for _, c := range slug {
+		if !(c >= 'a' && c <= 'z' || c >= '2' && c <= '7') {
+			return fmt.Errorf("slug contains invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+func checkSlug(req *http.Request, slugs *slugRegistry) error {
+	if slugs.main == "" {
 		return nil
 	}
 	shost := strings.Split(req.Host, ".")
 	if len(shost) < 3 {
 		return fmt.Errorf("hostname is too short")
 	}
-	if 1 != subtle.ConstantTimeCompare([]byte(slug), []byte(shost[len(shost)-3])) {
+	if !slugs.match(shost[len(shost)-3]) {
 		return fmt.Errorf("wrong slug")
 	}
 	return nil
 }
 
-func subdomainSluggedHandler(h http.Handler, slug string) http.Handler {
+// RequireHeader is a header that requests must carry.
+type RequireHeader struct {
+	Name  string
+	Value string
+}
+
+func checkHeader(req *http.Request, rh *RequireHeader) error {
+	if rh == nil {
+		return nil
+	}
+	if 1 != subtle.ConstantTimeCompare([]byte(rh.Value), []byte(req.Header.Get(rh.Name))) {
+		return fmt.Errorf("wrong %s header", rh.Name)
+	}
+	// Don't pass the secret further (e.g. to proxied server)
+	req.Header.Del(rh.Name)
+	return nil
+}
+
+func subdomainSluggedHandler(h http.Handler, slugs *slugRegistry, rh *RequireHeader, throttle throttler, miss http.Handler) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		err := checkSlug(req, slug)
+		err := checkSlug(req, slugs)
+		if err == nil {
+			err = checkHeader(req, rh)
+		}
 		if err != nil {
-			http.NotFound(w, req)
+			if throttle != nil {
+				throttle.throttle(req).wait()
+			}
+			miss.ServeHTTP(w, req)
 			return
 		}
 		h.ServeHTTP(w, req)
@@ -0,0 +1,120 @@
+package onionize
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const (
+	testSlug  = "abcdefghijklmnop"
+	testOnion = "iwsafoplitydwsahao2vliirrldcyhmiuwdk6bkdn6wbn2z3a4hs6uyd.onion"
+)
+
+// newTestSluggedHandler returns slugged handler with slug and rh
+// which answers "ok" and the value of header X-Secret it gets.
+func newTestSluggedHandler(t *testing.T, slug string, rh *RequireHeader) http.Handler {
+	t.Helper()
+	miss, err := newMissHandler(MissNotFound, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok" + req.Header.Get("X-Secret")))
+	})
+	return subdomainSluggedHandler(h, newSlugRegistry(slug, len(slug)), rh, nil, miss)
+}
+
+func TestRequireHeader(t *testing.T) {
+	rh := &RequireHeader{Name: "X-Secret", Value: "s3cret"}
+	for _, tc := range []struct {
+		name   string
+		slug   string
+		host   string
+		header []string
+		want   int
+	}{
+		{"present", "", testOnion, []string{"s3cret"}, http.StatusOK},
+		{"absent", "", testOnion, nil, http.StatusNotFound},
+		{"empty", "", testOnion, []string{""}, http.StatusNotFound},
+		{"wrong", "", testOnion, []string{"s3cre"}, http.StatusNotFound},
+		{"prefixed", "", testOnion, []string{"s3cret!"}, http.StatusNotFound},
+		{"second", "", testOnion, []string{"wrong", "s3cret"}, http.StatusNotFound},
+		{"with slug", testSlug, testSlug + "." + testOnion, []string{"s3cret"}, http.StatusOK},
+		{"with wrong slug", testSlug, "wrong." + testOnion, []string{"s3cret"}, http.StatusNotFound},
+		{"absent with slug", testSlug, testSlug + "." + testOnion, nil, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = tc.host
+			for _, v := range tc.header {
+				req.Header.Add(rh.Name, v)
+			}
+			w := httptest.NewRecorder()
+			newTestSluggedHandler(t, tc.slug, rh).ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Fatalf("got %d, want %d", w.Code, tc.want)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != "ok" {
+				t.Fatalf("header is passed to the share: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCheckSlug(t *testing.T) {
+	slugs := newSlugRegistry(testSlug, len(testSlug))
+	for host, ok := range map[string]bool{
+		testSlug + "." + testOnion:          true,
+		testSlug + "." + testOnion + ":80":  true,
+		"www." + testSlug + "." + testOnion: true,
+		"":                                  false,
+		"onion":                             false,
+		testOnion:                           false,
+		"." + testOnion:                     false,
+		testSlug[:8] + "." + testOnion:      false,
+		testSlug + "a." + testOnion:         false,
+		"wrongslugwrongsl." + testOnion:     false,
+		testSlug:                            false,
+	} {
+		req := &http.Request{Host: host, URL: &url.URL{Path: "/"}}
+		if err := checkSlug(req, slugs); (err == nil) != ok {
+			t.Errorf("host %q: %v, want accepted: %v", host, err, ok)
+		}
+	}
+	if err := checkSlug(&http.Request{Host: testOnion}, newSlugRegistry("", 0)); err != nil {
+		t.Errorf("request without slug is refused when there is no slug: %v", err)
+	}
+}
+
+func TestSluggedPaths(t *testing.T) {
+	h := newTestSluggedHandler(t, testSlug, nil)
+	for _, path := range []string{
+		"",
+		"/",
+		"/" + testSlug,
+		"/" + testSlug + "/",
+		"//",
+		"/%zz",
+		"/" + testSlug + "%00%ff%",
+	} {
+		for host, want := range map[string]int{
+			testSlug + "." + testOnion: http.StatusOK,
+			"wrong." + testOnion:       http.StatusNotFound,
+		} {
+			req := &http.Request{
+				Method: "GET",
+				Host:   host,
+				URL:    &url.URL{Path: path},
+				Header: make(http.Header),
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			// ServeMux redirects to the cleaned path whatever the slug is
+			if w.Code != want && w.Code/100 != 3 {
+				t.Errorf("path %q of %s: got %d, want %d", path, host, w.Code, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// stats.go - aggregate statistics of shares.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats are aggregate statistics of a share.
+type Stats struct {
+	// Connections is the number of connections accepted
+	Connections int64
+	// Requests is the number of requests which passed the checks
+	Requests int64
+	// Downloads is the number of completed downloads
+	Downloads int64
+	// BytesSent is the number of bytes of responses sent
+	BytesSent int64
+}
+
+type stats struct {
+	connections atomic.Int64
+	requests    atomic.Int64
+	downloads   atomic.Int64
+	bytesSent   atomic.Int64
+	// these are exposed as metrics only
+	active            atomic.Int64
+	misses            atomic.Int64
+	descriptorUploads atomic.Int64
+	torReconnects     atomic.Int64
+	statuses          statusCounts
+}
+
+// Stats returns statistics of the share so far.
+func (s *Service) Stats() Stats {
+	return Stats{
+		Connections: s.stats.connections.Load(),
+		Requests:    s.stats.requests.Load(),
+		Downloads:   s.stats.downloads.Load(),
+		BytesSent:   s.stats.bytesSent.Load(),
+	}
+}
+
+// countingWriter adds the number of bytes written to n.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,129 @@
+// stopafter.go - stop sharing after a number of downloads.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// statusWriter records status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	// err is the first error of writing the response
+	err error
+	// progress (if set) is called with written after every write
+	progress func(written int64)
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.progress != nil && n > 0 {
+		w.progress(w.written)
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// complete reports whether the whole content was sent: all of
+// Content-Length if it's declared, everything handler wrote
+// otherwise.
+func (w *statusWriter) complete() bool {
+	if w.status != http.StatusOK || w.err != nil {
+		return false
+	}
+	cl, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	return err != nil || w.written == cl
+}
+
+// downloadCounter counts complete downloads. It calls stop once
+// limit (unless zero) downloads are completed, completed (if set)
+// after every download and progress (if set) while content is sent
+// with total size of it (-1 if unknown).
+type downloadCounter struct {
+	limit     int64
+	count     int64
+	stop      func()
+	completed func(req *http.Request, n int64)
+	progress  func(req *http.Request, n, total int64)
+}
+
+func newDownloadCounter(limit int, stop func(), completed func(*http.Request, int64), progress func(*http.Request, int64, int64)) *downloadCounter {
+	if limit <= 0 && completed == nil && progress == nil {
+		return nil
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	return &downloadCounter{
+		limit:     int64(limit),
+		stop:      stop,
+		completed: completed,
+		progress:  progress,
+	}
+}
+
+// handler counts complete GET responses of h to requests for which
+// isContent returns true. Content is not served anymore after
+// the limit is reached.
+func (dc *downloadCounter) handler(h http.Handler, isContent func(*http.Request) bool) http.Handler {
+	if dc == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isContent(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if dc.limit != 0 && atomic.LoadInt64(&dc.count) >= dc.limit {
+			http.NotFound(w, req)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		if dc.progress != nil && req.Method == "GET" {
+			sw.progress = func(n int64) {
+				total, err := strconv.ParseInt(sw.Header().Get("Content-Length"), 10, 64)
+				if err != nil {
+					total = -1
+				}
+				dc.progress(req, n, total)
+			}
+		}
+		h.ServeHTTP(sw, req)
+		if req.Method != "GET" || !sw.complete() {
+			return
+		}
+		if dc.completed != nil {
+			dc.completed(req, sw.written)
+		}
+		if atomic.AddInt64(&dc.count, 1) == dc.limit {
+			go dc.stop()
+		}
+	})
+}
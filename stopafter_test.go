@@ -0,0 +1,82 @@
+package onionize
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// brokenWriter fails writes once limit bytes are written, as if
+// the client is gone.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *brokenWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		n, _ := w.ResponseRecorder.Write(b[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection reset")
+	}
+	w.limit -= len(b)
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStopAfterComplete(t *testing.T) {
+	content := make([]byte, 1000)
+	for _, tc := range []struct {
+		name     string
+		length   bool // declare Content-Length
+		sent     int  // bytes the handler sends
+		limit    int  // bytes the client receives
+		complete bool
+	}{
+		{"full", true, 1000, 1000, true},
+		{"full chunked", false, 1000, 1000, true},
+		{"short", true, 500, 1000, false},
+		{"cut off", true, 1000, 500, false},
+		{"cut off chunked", false, 1000, 500, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var completed int
+			dc := newDownloadCounter(0, func() {}, func(*http.Request, int64) { completed++ }, nil)
+			h := dc.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if tc.length {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				}
+				// Write as a file server does, not caring about errors
+				for sent := 0; sent < tc.sent; sent += 100 {
+					w.Write(content[sent : sent+100])
+				}
+			}), func(*http.Request) bool { return true })
+			w := &brokenWriter{ResponseRecorder: httptest.NewRecorder(), limit: tc.limit}
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/file", nil))
+			if (completed == 1) != tc.complete {
+				t.Fatalf("download is counted %d times, want complete: %v", completed, tc.complete)
+			}
+		})
+	}
+}
+
+func TestStopAfter(t *testing.T) {
+	stopped := make(chan struct{})
+	dc := newDownloadCounter(2, func() { close(stopped) }, nil, nil)
+	h := dc.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("content"))
+	}), func(req *http.Request) bool { return req.URL.Path == "/file" })
+	for i := 0; i < 3; i++ {
+		get(h, "/")
+	}
+	for i := 0; i < 2; i++ {
+		if w := get(h, "/file"); w.Code != http.StatusOK {
+			t.Fatalf("download %d: %d", i, w.Code)
+		}
+	}
+	<-stopped
+	if w := get(h, "/file"); w.Code != http.StatusNotFound {
+		t.Fatalf("download over the limit: %d", w.Code)
+	}
+}
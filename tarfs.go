@@ -0,0 +1,234 @@
+// tarfs.go - serve contents of tar archives.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/tools/godoc/vfs"
+	"golang.org/x/tools/godoc/vfs/zipfs"
+)
+
+// Signatures of a zip archive with files and of an empty one.
+var zipMagics = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+
+// openArchive opens archive at name as vfs.FileSystem. Format of the
+// archive (zip, tar, gzipped or xz-compressed tar) is detected by its
+// contents. It returns kind of the share as well.
+func openArchive(name string) (vfs.FileSystem, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to open archive: %v", err)
+	}
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	f.Seek(0, io.SeekStart)
+	// Compressed tarballs are read via dr
+	var dr io.Reader
+	switch {
+	case slices.ContainsFunc(zipMagics, func(m []byte) bool { return bytes.HasPrefix(magic, m) }):
+		f.Close()
+		rcZip, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to open zip archive: %v", err)
+		}
+		return zipfs.New(rcZip, "zipfs"), "zip", nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		dr, err = gzip.NewReader(bufio.NewReader(f))
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		dr, err = xz.NewReader(bufio.NewReader(f))
+	}
+	if err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("Unable to open compressed archive: %v", err)
+	}
+	if dr != nil {
+		tmp, err := decompress(dr)
+		f.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to decompress archive: %v", err)
+		}
+		f = tmp
+	}
+	tfs, err := newTarFS(tar.NewReader(f), f)
+	if err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("Unable to read tar archive: %v", err)
+	}
+	return tfs, "tar", nil
+}
+
+// decompress writes contents of r into a temporary file and returns
+// it rewound, so that files of compressed archives are served from
+// disk rather than memory. The file is removed right away to be gone
+// with the process (where open files can't be removed it's left in
+// the temporary directory).
+func decompress(r io.Reader) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "onionize-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// tarEntry is a file or a directory of tar archive.
+type tarEntry struct {
+	fi   os.FileInfo
+	data io.ReaderAt
+	// names of directory entries
+	children map[string]bool
+}
+
+// tarFS is a vfs.FileSystem of contents of a tar archive. Only
+// regular files and directories are kept. Files are read from the
+// (decompressed) archive file.
+type tarFS struct {
+	entries map[string]*tarEntry
+}
+
+func newTarFS(tr *tar.Reader, f *os.File) (*tarFS, error) {
+	tfs := &tarFS{entries: map[string]*tarEntry{
+		"/": {fi: tarDirInfo("/"), children: map[string]bool{}},
+	}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			tfs.mkdirAll(name)
+		case tar.TypeReg:
+			off, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			data := io.NewSectionReader(f, off, hdr.Size)
+			// Don't let files replace directories
+			if e, ok := tfs.entries[name]; (ok && e.fi.IsDir()) || !tfs.mkdirAll(path.Dir(name)) {
+				continue
+			}
+			tfs.entries[path.Dir(name)].children[path.Base(name)] = true
+			tfs.entries[name] = &tarEntry{fi: hdr.FileInfo(), data: data}
+		}
+	}
+	return tfs, nil
+}
+
+// mkdirAll adds directory name and its parents unless they exist.
+// It reports whether name is a directory.
+func (tfs *tarFS) mkdirAll(name string) bool {
+	if e, ok := tfs.entries[name]; ok {
+		return e.fi.IsDir()
+	}
+	parent := path.Dir(name)
+	if !tfs.mkdirAll(parent) {
+		return false
+	}
+	tfs.entries[parent].children[path.Base(name)] = true
+	tfs.entries[name] = &tarEntry{fi: tarDirInfo(name), children: map[string]bool{}}
+	return true
+}
+
+func (tfs *tarFS) entry(p string) (*tarEntry, error) {
+	e, ok := tfs.entries[path.Clean("/"+p)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+func (tfs *tarFS) Open(p string) (vfs.ReadSeekCloser, error) {
+	e, err := tfs.entry(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: p, Err: errors.New("is a directory")}
+	}
+	return nopReadSeekCloser{io.NewSectionReader(e.data, 0, e.fi.Size())}, nil
+}
+
+func (tfs *tarFS) Lstat(p string) (os.FileInfo, error) {
+	return tfs.Stat(p)
+}
+
+func (tfs *tarFS) Stat(p string) (os.FileInfo, error) {
+	e, err := tfs.entry(p)
+	if err != nil {
+		return nil, err
+	}
+	return e.fi, nil
+}
+
+func (tfs *tarFS) ReadDir(p string) ([]os.FileInfo, error) {
+	e, err := tfs.entry(p)
+	if err != nil {
+		return nil, err
+	}
+	if !e.fi.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: errors.New("not a directory")}
+	}
+	dir := path.Clean("/" + p)
+	fis := make([]os.FileInfo, 0, len(e.children))
+	for name := range e.children {
+		fis = append(fis, tfs.entries[path.Join(dir, name)].fi)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (tfs *tarFS) RootType(string) vfs.RootType { return "" }
+
+func (tfs *tarFS) String() string { return "tarfs" }
+
+// tarDirInfo is os.FileInfo of a directory of tar archive.
+type tarDirInfo string
+
+func (fi tarDirInfo) Name() string       { return path.Base(string(fi)) }
+func (fi tarDirInfo) Size() int64        { return 0 }
+func (fi tarDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (fi tarDirInfo) ModTime() time.Time { return time.Time{} }
+func (fi tarDirInfo) IsDir() bool        { return true }
+func (fi tarDirInfo) Sys() interface{}   { return nil }
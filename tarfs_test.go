@@ -0,0 +1,99 @@
+package onionize
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// tarball returns tar archive of files sorted by name.
+func tarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		content := files[name]
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		// Plain tarball starts with this name
+		"PKfile":    "pk",
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	}
+	tb := tarball(t, files)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(tb)
+	zw.Close()
+	var xzb bytes.Buffer
+	xw, err := xz.NewWriter(&xzb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(tb)
+	xw.Close()
+	archives := map[string][]byte{
+		"archive.tar":    tb,
+		"archive.tar.gz": gz.Bytes(),
+		"archive.tar.xz": xzb.Bytes(),
+	}
+	writeZip(t, filepath.Join(dir, "archive.zip"), files)
+	for name, b := range archives {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, wantKind := range map[string]string{
+		"archive.zip":    "zip",
+		"archive.tar":    "tar",
+		"archive.tar.gz": "tar",
+		"archive.tar.xz": "tar",
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs, kind, err := openArchive(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != wantKind {
+				t.Errorf("kind is %q, want %q", kind, wantKind)
+			}
+			for fname, content := range files {
+				f, err := fs.Open("/" + fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(f)
+				f.Close()
+				if err != nil || string(b) != content {
+					t.Errorf("%s: got %q (%v), want %q", fname, b, err, content)
+				}
+			}
+		})
+	}
+}
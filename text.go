@@ -0,0 +1,93 @@
+// text.go - share snippets of text.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Formats of shared text.
+const (
+	// Shown as is (default).
+	TextFormatPlain = "plain"
+	// Rendered as markdown: headings, lists, quotes, code blocks,
+	// emphasis and links.
+	TextFormatMarkdown = "markdown"
+)
+
+// TextPage is the data the "text" template is executed with.
+type TextPage struct {
+	Title string
+	// Text is the shared text as is
+	Text string
+	// HTML is Text rendered as markdown if it's the format
+	HTML template.HTML
+}
+
+// textPage serves text as a page with a copy button at "/" and as
+// is at "/?raw".
+type textPage struct {
+	page []byte
+	text string
+	log  *slog.Logger
+}
+
+func newTextPage(p Parameters) (*textPage, error) {
+	tp := TextPage{Title: p.ContentName, Text: p.Text}
+	if tp.Title == "" {
+		tp.Title = "Text"
+	}
+	switch p.TextFormat {
+	case "", TextFormatPlain:
+	case TextFormatMarkdown:
+		tp.HTML = renderMarkdown(p.Text)
+	default:
+		return nil, fmt.Errorf("Unknown text format: %q", p.TextFormat)
+	}
+	var b bytes.Buffer
+	if err := lookupTemplate(p.Templates, "text").Execute(&b, tp); err != nil {
+		return nil, fmt.Errorf("Unable to render text page: %v", err)
+	}
+	return &textPage{page: b.Bytes(), text: p.Text, log: logger(p)}, nil
+}
+
+func (t *textPage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	t.log.Debug("Request", "path", req.URL.Path, "remote", req.RemoteAddr)
+	body, ctype := t.page, "text/html; charset=utf-8"
+	if _, raw := req.URL.Query()["raw"]; raw {
+		body, ctype = []byte(t.text), "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ctype)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+}
+
+// isDownload reports whether req is for the text.
+func (t *textPage) isDownload(req *http.Request) bool {
+	return req.URL.Path == "/"
+}
+
+// OnionizeText shares text like Onionize shares files. The text is
+// shown as p.TextFormat with p.ContentName as the title.
+func OnionizeText(ctx context.Context, p Parameters, text string, linkChan chan<- ResultLink) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("No text to share")
+	}
+	p.Text = text
+	return Onionize(ctx, p, linkChan)
+}
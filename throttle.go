@@ -0,0 +1,142 @@
+// throttle.go - slow down slug guessing.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Misses are forgotten with this time constant.
+	missDecay = time.Minute
+	// Number of recent misses tolerated without delay.
+	missThreshold = 10
+	missBaseDelay = 100 * time.Millisecond
+	missMaxDelay  = 10 * time.Second
+	// Maximum number of concurrently delayed responses. Misses
+	// beyond that are answered immediately so delays can't be used
+	// to tie up server resources.
+	missMaxDelayed = 32
+	// Maximum number of clients to keep track of.
+	maxClientThrottles = 4096
+)
+
+// missThrottle delays responses to requests with a wrong slug
+// exponentially in the recent rate of such requests. Misses are
+// accounted globally since there is no way to tell clients apart
+// over tor.
+type missThrottle struct {
+	sync.Mutex
+	score   float64
+	last    time.Time
+	delayed int
+}
+
+// miss records a miss and returns the delay to apply to it.
+// release must be called after the delay if it is non-zero.
+func (t *missThrottle) miss() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	t.score = t.score*math.Exp(-float64(now.Sub(t.last))/float64(missDecay)) + 1
+	t.last = now
+	if t.score <= missThreshold || t.delayed >= missMaxDelayed {
+		return 0
+	}
+	d := missMaxDelay
+	if e := t.score - missThreshold; e < 32 {
+		d = time.Duration(float64(missBaseDelay) * math.Exp2(e))
+		if d > missMaxDelay {
+			d = missMaxDelay
+		}
+	}
+	t.delayed++
+	return d
+}
+
+func (t *missThrottle) release() {
+	t.Lock()
+	t.delayed--
+	t.Unlock()
+}
+
+// throttler picks the throttle to account a miss of req against.
+type throttler interface {
+	throttle(req *http.Request) *missThrottle
+}
+
+// throttle accounts all misses against t.
+func (t *missThrottle) throttle(*http.Request) *missThrottle {
+	return t
+}
+
+// clientThrottles account misses per client address. Over onion
+// services every connection comes from tor, so all of them are
+// accounted together: tor can't tell circuits of clients via
+// ADD_ONION. Once maxClientThrottles clients missed lately, misses
+// of new ones are accounted together in overflow.
+type clientThrottles struct {
+	sync.Mutex
+	m        map[string]*missThrottle
+	overflow missThrottle
+	// forgotten is when forget was run last
+	forgotten time.Time
+}
+
+func newClientThrottles() *clientThrottles {
+	return &clientThrottles{m: make(map[string]*missThrottle)}
+}
+
+func (ct *clientThrottles) throttle(req *http.Request) *missThrottle {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ct.Lock()
+	defer ct.Unlock()
+	t, ok := ct.m[host]
+	if !ok {
+		if len(ct.m) >= maxClientThrottles && time.Since(ct.forgotten) > time.Second {
+			ct.forget()
+		}
+		if len(ct.m) >= maxClientThrottles {
+			return &ct.overflow
+		}
+		t = &missThrottle{}
+		ct.m[host] = t
+	}
+	return t
+}
+
+// forget drops throttles of clients which haven't missed lately.
+func (ct *clientThrottles) forget() {
+	ct.forgotten = time.Now()
+	for host, t := range ct.m {
+		t.Lock()
+		idle := t.delayed == 0 && time.Since(t.last) > 5*missDecay
+		t.Unlock()
+		if idle {
+			delete(ct.m, host)
+		}
+	}
+}
+
+// wait delays the response to a miss.
+func (t *missThrottle) wait() {
+	if t == nil {
+		return
+	}
+	if d := t.miss(); d > 0 {
+		time.Sleep(d)
+		t.release()
+	}
+}
@@ -0,0 +1,48 @@
+package onionize
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientThrottlesCap(t *testing.T) {
+	ct := newClientThrottles()
+	missFrom := func(host string) *missThrottle {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = host + ":1234"
+		th := ct.throttle(req)
+		th.miss()
+		return th
+	}
+	for i := 0; i < maxClientThrottles; i++ {
+		missFrom(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	if th := missFrom("10.0.0.1"); th == &ct.overflow {
+		t.Fatal("known client is accounted in overflow")
+	}
+	for i := 0; i < 1000; i++ {
+		if th := missFrom(fmt.Sprintf("10.1.%d.%d", i/256, i%256)); th != &ct.overflow {
+			t.Fatal("new client is tracked beyond the limit")
+		}
+	}
+	if len(ct.m) > maxClientThrottles {
+		t.Fatalf("%d clients are tracked, want up to %d", len(ct.m), maxClientThrottles)
+	}
+	if ct.overflow.score < missThreshold {
+		t.Fatal("misses of new clients are not accounted")
+	}
+
+	// Clients which haven't missed lately are forgotten
+	for _, th := range ct.m {
+		th.last = time.Now().Add(-6 * missDecay)
+	}
+	ct.forgotten = time.Time{}
+	if th := missFrom("10.2.0.1"); th == &ct.overflow {
+		t.Fatal("idle clients are not forgotten")
+	}
+	if len(ct.m) != 1 {
+		t.Fatalf("%d clients are tracked after forgetting idle ones", len(ct.m))
+	}
+}
@@ -8,36 +8,204 @@
 package onionize
 
 import (
-	"net"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/nogoegst/bulb"
 )
 
 const torrc = `RunAsDaemon 0
 SOCKSPort 0
-ControlPort 9999
+ControlPort auto
+CookieAuthentication 1
 AvoidDiskWrites 1
 `
 
-func runTor(ready chan<- struct{}) error {
-	cmd := exec.Command("tor", "-f", "-")
-	cmd.Stdin = strings.NewReader(torrc)
+// torProcess is a tor instance run by onionize. It lives in its own
+// temporary data directory and exits along with onionize.
+type torProcess struct {
+	cmd     *exec.Cmd
+	dataDir string
+	exited  chan error
+	// ControlPath to connect to the instance
+	controlPath string
+}
+
+// torBinary returns tor binary to run: torPath if set, tor bundled
+// next to the executable if there is one, or tor from PATH.
+func torBinary(torPath string) string {
+	if torPath != "" {
+		return torPath
+	}
+	name := "tor"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	if exe, err := os.Executable(); err == nil {
+		bundled := filepath.Join(filepath.Dir(exe), name)
+		if fi, err := os.Stat(bundled); err == nil && !fi.IsDir() {
+			return bundled
+		}
+	}
+	return name
+}
+
+// startTor runs tor and waits for it to open its control port.
+// Tor exits as soon as onionize does: it is owned by this process.
+func startTor(torPath string) (t *torProcess, err error) {
+	dataDir, err := os.MkdirTemp("", "onionize-tor-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dataDir)
+		}
+	}()
+	portFile := filepath.Join(dataDir, "control-port")
+	conf := torrc +
+		fmt.Sprintf("DataDirectory %s\n", dataDir) +
+		fmt.Sprintf("ControlPortWriteToFile %s\n", portFile) +
+		fmt.Sprintf("__OwningControllerProcess %d\n", os.Getpid())
+	cmd := exec.Command(torBinary(torPath), "-f", "-")
+	cmd.Stdin = strings.NewReader(conf)
 	cmd.Stderr = os.Stderr
-	err := cmd.Start()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	t = &torProcess{
+		cmd:     cmd,
+		dataDir: dataDir,
+		exited:  make(chan error, 1),
+	}
+	go func() {
+		t.exited <- cmd.Wait()
+		close(t.exited)
+	}()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-t.exited:
+			if err == nil {
+				err = errors.New("tor exited before opening control port")
+			}
+			os.RemoveAll(dataDir)
+			return nil, err
+		case <-tick.C:
+			b, err := os.ReadFile(portFile)
+			// tor writes the file as a whole only when it's complete
+			if err != nil || !strings.HasSuffix(string(b), "\n") {
+				continue
+			}
+			addr := strings.TrimPrefix(strings.TrimSpace(string(b)), "PORT=")
+			t.controlPath = "tcp://" + addr
+			return t, nil
+		}
+	}
+}
+
+// takeOwnership makes tor exit when c is closed and waits for tor
+// to bootstrap.
+func (t *torProcess) takeOwnership(c *bulb.Conn) error {
+	if _, err := c.Request("TAKEOWNERSHIP"); err != nil {
+		return fmt.Errorf("TAKEOWNERSHIP has failed: %v", err)
+	}
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		resp, err := c.Request("GETINFO status/bootstrap-phase")
+		if err != nil {
+			return fmt.Errorf("Unable to get bootstrap status: %v", err)
+		}
+		progress := bootstrapProgress(resp.Data)
+		if progress == 100 {
+			return nil
+		}
+		select {
+		case <-t.exited:
+			return errors.New("tor exited while bootstrapping")
+		case <-tick.C:
+		}
+	}
+}
+
+// bootstrapProgress extracts value of PROGRESS from GETINFO
+// status/bootstrap-phase reply.
+func bootstrapProgress(data []string) int {
+	for _, l := range data {
+		for _, f := range strings.Fields(l) {
+			if v, ok := strings.CutPrefix(f, "PROGRESS="); ok {
+				progress, _ := strconv.Atoi(v)
+				return progress
+			}
+		}
+	}
+	return 0
+}
+
+// stop kills tor and removes its data directory.
+func (t *torProcess) stop() {
+	if t == nil {
+		return
+	}
+	t.cmd.Process.Kill()
+	<-t.exited
+	os.RemoveAll(t.dataDir)
+}
+
+// Tor is a tor instance run by onionize for several shares to
+// publish their onions via (see Parameters.ControlPath).
+type Tor struct {
+	process *torProcess
+	// owner keeps tor running
+	owner *bulb.Conn
+}
+
+// RunTor runs tor like Parameters.StartTor does and waits for it
+// to bootstrap. Tor exits on Close or once this process exits.
+// Tor next to the executable or tor from PATH is run unless
+// torPath is set.
+func RunTor(torPath string) (t *Tor, err error) {
+	tp, err := startTor(torPath)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Unable to run tor: %v", err)
 	}
-	t := time.NewTicker(500 * time.Millisecond)
-	for range t.C {
-		c, err := net.Dial("tcp", "127.0.0.1:9999")
-		if err == nil {
-			c.Close()
-			t.Stop()
-			ready <- struct{}{}
-			break
+	defer func() {
+		if err != nil {
+			tp.stop()
 		}
+	}()
+	c, err := bulb.DialURL(tp.controlPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to control socket: %v", err)
+	}
+	if err := authenticate(c, ""); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Authentication failed: %v", err)
 	}
-	return cmd.Wait()
+	if err := tp.takeOwnership(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Unable to bootstrap tor: %v", err)
+	}
+	return &Tor{process: tp, owner: c}, nil
+}
+
+// ControlPath is the path to connect to tor control port with.
+func (t *Tor) ControlPath() string {
+	return t.process.controlPath
+}
+
+// Close stops tor. Onions of shares published via it are gone.
+func (t *Tor) Close() error {
+	err := t.owner.Close()
+	t.process.stop()
+	return err
 }
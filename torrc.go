@@ -0,0 +1,43 @@
+// torrc.go - torrc snippets for permanent onion services.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+)
+
+const torrcHiddenServiceDir = "/var/lib/tor/onionize/"
+
+// GenerateTorrcSnippet returns torrc lines that set up a permanent
+// onion service equivalent to the share configured by p forwarding
+// connections to addr. Comments explain where to put the key
+// exported with p.ExportKeyPath.
+func GenerateTorrcSnippet(p Parameters, addr string) string {
+	version, keyFile := 3, "hs_ed25519_secret_key"
+	if _, ok := p.IdentityKey.(*rsa.PrivateKey); ok || (p.IdentityKey == nil && p.KeyType == KeyTypeRSA1024) {
+		version, keyFile = 2, "private_key"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Permanent onion service equivalent to the onionize share.\n")
+	switch {
+	case p.ExportKeyPath != "":
+		fmt.Fprintf(&b, "# Copy %s to %s%s readable by tor only\n", p.ExportKeyPath, torrcHiddenServiceDir, keyFile)
+		fmt.Fprintf(&b, "# to keep the onion address.\n")
+	default:
+		fmt.Fprintf(&b, "# Tor generates a new key (and address) in HiddenServiceDir.\n")
+		fmt.Fprintf(&b, "# Export the key to keep the address of the share.\n")
+	}
+	fmt.Fprintf(&b, "HiddenServiceDir %s\n", torrcHiddenServiceDir)
+	fmt.Fprintf(&b, "HiddenServiceVersion %d\n", version)
+	for _, port := range virtualPorts(p) {
+		fmt.Fprintf(&b, "HiddenServicePort %d %s\n", port, addr)
+	}
+	return b.String()
+}
@@ -19,16 +19,28 @@ var (
 	tCost = 2
 )
 
-func KeystreamReader(passphrase, salt []byte) io.Reader {
+// Secret derives secret from passphrase and salt. It takes a while
+// and a lot of memory on purpose.
+func Secret(passphrase, salt []byte) []byte {
 	h, err := blake2b.New512(nil)
 	if err != nil {
 		panic(err)
 	}
-	secret := balloon.Balloon(h, passphrase, salt, uint64(sCost/h.Size()), uint64(tCost))
-	b2xb, err := blake2b.NewXOF(blake2b.OutputLengthUnknown, nil)
+	return balloon.Balloon(h, passphrase, salt, uint64(sCost/h.Size()), uint64(tCost))
+}
+
+// SecretReader returns keystream of secret for purpose. Keystreams
+// for different purposes are unrelated. Keystream for nil purpose
+// is the one of KeystreamReader.
+func SecretReader(secret, purpose []byte) io.Reader {
+	b2xb, err := blake2b.NewXOF(blake2b.OutputLengthUnknown, purpose)
 	if err != nil {
 		panic(err)
 	}
 	b2xb.Write(secret)
 	return b2xb
 }
+
+func KeystreamReader(passphrase, salt []byte) io.Reader {
+	return SecretReader(Secret(passphrase, salt), nil)
+}
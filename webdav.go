@@ -0,0 +1,77 @@
+// webdav.go - share directory over WebDAV.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/webdav"
+)
+
+// webdavDir returns the directory to share over WebDAV.
+func webdavDir(p Parameters) (string, error) {
+	dir := p.Pathspec
+	if len(p.Paths) != 0 {
+		if len(p.Paths) != 1 {
+			return "", fmt.Errorf("Only one directory can be shared over WebDAV")
+		}
+		dir = p.Paths[0]
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("Unable to use WebDAV directory: %v", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// newWebDAV returns handler serving the directory of p over
+// WebDAV. Clients may change it unless p.WebDAVReadOnly is set;
+// FileReceived is emitted for every file put there.
+func newWebDAV(p Parameters, emit func(Event)) (http.Handler, error) {
+	dir, err := webdavDir(p)
+	if err != nil {
+		return nil, err
+	}
+	log := logger(p)
+	h := &webdav.Handler{
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				log.Debug("WebDAV request failed", "method", req.Method, "path", req.URL.Path, "err", err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p.WebDAVReadOnly && !webdavReadMethod(req.Method) {
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+			http.Error(w, "Share is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, req)
+		if req.Method == http.MethodPut && (sw.status == http.StatusCreated || sw.status == http.StatusNoContent) {
+			log.Debug("Received", "name", req.URL.Path, "remote", req.RemoteAddr)
+			emit(FileReceived{Name: req.URL.Path, Bytes: req.ContentLength})
+		}
+	}), nil
+}
+
+// webdavReadMethod reports whether method doesn't change anything.
+func webdavReadMethod(method string) bool {
+	switch method {
+	case http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// wellknown.go - serve documents under /.well-known/.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const wellKnownPrefix = "/.well-known/"
+
+// docEntry is a document served under /.well-known/.
+type docEntry struct {
+	ctype   string
+	content string
+}
+
+// wellKnownHandler serves docs (name to content) under /.well-known/
+// bypassing h. Only exact paths of docs are served, everything else
+// goes to h.
+func wellKnownHandler(h http.Handler, docs map[string]string) (http.Handler, error) {
+	entries := make(map[string]docEntry)
+	for name, content := range docs {
+		p := path.Clean(wellKnownPrefix + strings.TrimPrefix(name, wellKnownPrefix))
+		if !strings.HasPrefix(p, wellKnownPrefix) {
+			return nil, fmt.Errorf("Well-known path %q is outside of %s", name, wellKnownPrefix)
+		}
+		if _, ok := entries[p]; ok {
+			return nil, fmt.Errorf("Well-known path %s is given twice", p)
+		}
+		ctype := mime.TypeByExtension(path.Ext(p))
+		if ctype == "" {
+			ctype = "text/plain; charset=utf-8"
+		}
+		entries[p] = docEntry{ctype: ctype, content: content}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e, ok := entries[req.URL.Path]
+		if !ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", e.ctype)
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(e.content))
+	}), nil
+}
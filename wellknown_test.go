@@ -0,0 +1,57 @@
+package onionize
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestWellKnown(t *testing.T) {
+	for _, docs := range []map[string]string{
+		{"a": "a", "/.well-known/a": "a"},
+		{"a": "a", "./a": "a"},
+		{"../a": "a"},
+		{"": "a"},
+	} {
+		if _, err := wellKnownHandler(http.NotFoundHandler(), docs); err == nil {
+			t.Errorf("%v is accepted", docs)
+		}
+	}
+
+	link, onion := share(t, newFake(t), Parameters{Text: "secret", Slug: true, WellKnown: map[string]string{
+		"security.txt":             "Contact: mailto:me@example.org",
+		"my file.txt":              "spaced",
+		"{x}":                      "literal",
+		"/.well-known/dir/doc.txt": "nested",
+	}})
+	noSlug := onion.ID + ".onion"
+	for path, want := range map[string]string{
+		"/.well-known/security.txt":    "Contact: mailto:me@example.org",
+		"/.well-known/my%20file.txt":   "spaced",
+		"/.well-known/%7Bx%7D":         "literal",
+		"/.well-known/dir/doc.txt":     "nested",
+		"/.well-known/security.txt?ok": "Contact: mailto:me@example.org",
+	} {
+		resp, body := fetch(t, onion, noSlug, path)
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("%s without slug: %d %q, want %q", path, resp.StatusCode, body, want)
+		}
+	}
+	// Anything else is behind the slug
+	for _, path := range []string{
+		"/",
+		"/.well-known/",
+		"/.well-known/other",
+		"/.well-known/x",
+		"/.well-known/security.txt/",
+		"/.well-known/dir/",
+		"/.well-known/" + url.PathEscape("my file.txt") + "x",
+	} {
+		if resp, body := fetch(t, onion, noSlug, path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s without slug: %d %q", path, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := fetch(t, onion, link.Host, "/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("share with slug: %d", resp.StatusCode)
+	}
+}
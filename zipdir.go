@@ -0,0 +1,241 @@
+// zipdir.go - serve directories as zip archives made on the fly.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionize, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionize
+
+import (
+	"archive/zip"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// zipDir serves paths zipped into a single archive. The archive is
+// written straight to the client, so its size isn't known in advance.
+type zipDir struct {
+	// path of the archive
+	name     string
+	aliasmap map[string]string
+	// maskModTimes leaves modification times out of the archive
+	maskModTimes bool
+	log          *slog.Logger
+}
+
+func newZipDir(p Parameters) (*zipDir, error) {
+	aliasmap, err := shareAliasmap(p)
+	if err != nil {
+		return nil, err
+	}
+	name := "onionize"
+	if len(aliasmap) == 1 {
+		for alias, realpath := range aliasmap {
+			name = alias
+			if alias == "." {
+				name = filepath.Base(realpath)
+			}
+		}
+	}
+	return &zipDir{
+		name:         "/" + name + ".zip",
+		aliasmap:     aliasmap,
+		maskModTimes: p.MaskModTimes,
+		log:          logger(p),
+	}, nil
+}
+
+// within reports whether path p is inside directory root.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// zipWriter writes files of vfs.FileSystem to a zip archive.
+type zipWriter struct {
+	*zip.Writer
+	// maskModTimes leaves modification times out of the archive
+	maskModTimes bool
+}
+
+func newZipWriter(w io.Writer, maskModTimes bool) *zipWriter {
+	return &zipWriter{Writer: zip.NewWriter(w), maskModTimes: maskModTimes}
+}
+
+// addDir writes directory entry name.
+func (zw *zipWriter) addDir(name string) error {
+	_, err := zw.Create(name + "/")
+	return err
+}
+
+// addFile writes file p of fsys as name.
+func (zw *zipWriter) addFile(fsys vfs.FileSystem, p, name string, fi os.FileInfo) error {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	if zw.maskModTimes {
+		hdr.Modified = time.Time{}
+		hdr.ModifiedTime, hdr.ModifiedDate = 0, 0
+	}
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(w, f)
+	return err
+}
+
+// add writes file rel of directory root to zw as name. Symlinks
+// are followed only to files inside root.
+func (zd *zipDir) add(zw *zipWriter, root, rel, name string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := filepath.EvalSymlinks(filepath.Join(root, rel))
+		if err != nil || !within(root, target) {
+			return nil
+		}
+		if fi, err = os.Stat(target); err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	return zw.addFile(vfs.OS(root), filepath.ToSlash(rel), name, fi)
+}
+
+func (zd *zipDir) write(w io.Writer) error {
+	zw := newZipWriter(w, zd.maskModTimes)
+	aliases := make([]string, 0, len(zd.aliasmap))
+	for alias := range zd.aliasmap {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		root, err := filepath.EvalSymlinks(zd.aliasmap[alias])
+		if err != nil {
+			return err
+		}
+		prefix := alias
+		if alias == "." {
+			prefix = filepath.Base(root)
+		}
+		err = filepath.Walk(root, func(realpath string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, realpath)
+			if err != nil {
+				return err
+			}
+			name := path.Join(prefix, filepath.ToSlash(rel))
+			if fi.IsDir() {
+				return zw.addDir(name)
+			}
+			return zd.add(zw, root, rel, name, fi)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (zd *zipDir) isArchive(req *http.Request) bool {
+	return req.URL.Path == zd.name
+}
+
+func (zd *zipDir) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/" {
+		http.Redirect(w, req, escapePath(zd.name), http.StatusFound)
+		return
+	}
+	if req.URL.Path != zd.name {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachment(path.Base(zd.name)))
+	if req.Method == "HEAD" {
+		return
+	}
+	if err := zd.write(w); err != nil {
+		// Headers are gone already, so just drop the connection
+		zd.log.Error("Unable to zip", "name", zd.name, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// zipName returns name of the archive of directory dir.
+func zipName(dir string) string {
+	name := path.Base(dir)
+	if name == "/" || name == "." {
+		name = "onionize"
+	}
+	return name + ".zip"
+}
+
+// isZip reports whether req asks for directory of fs as a zip
+// archive.
+func (fs *fileServer) isZip(req *http.Request) bool {
+	if !fs.zipDownloads || req.URL.Query().Get("download") != "zip" {
+		return false
+	}
+	fi, err := fs.fs.Stat(path.Clean(req.URL.Path))
+	return err == nil && fi.IsDir()
+}
+
+// isDownload reports whether req is for a file or a zip archive.
+func (fs *fileServer) isDownload(req *http.Request) bool {
+	return fs.isFile(req) || fs.isZip(req)
+}
+
+// writeZip writes files under dir of fs to w as a zip archive.
+func (fs *fileServer) writeZip(w io.Writer, dir string) error {
+	zw := newZipWriter(w, fs.maskModTimes)
+	prefix := strings.TrimSuffix(zipName(dir), ".zip")
+	var werr error
+	err := fs.walk(dir, func(p string, fi os.FileInfo) {
+		if werr == nil {
+			werr = zw.addFile(fs.fs, p, path.Join(prefix, strings.TrimPrefix(p, dir)), fi)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	return zw.Close()
+}
+
+// serveZip streams directory dir as a zip archive.
+func (fs *fileServer) serveZip(w http.ResponseWriter, req *http.Request, dir string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachment(zipName(dir)))
+	if req.Method == "HEAD" {
+		return
+	}
+	if err := fs.writeZip(w, dir); err != nil {
+		// Headers are gone already, so just drop the connection
+		fs.log.Error("Unable to zip", "name", dir, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,66 @@
+package onionize
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readZip returns modification times and contents of files of zip
+// archive b.
+func readZip(t *testing.T, b []byte) map[string]zip.FileHeader {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("invalid archive: %v", err)
+	}
+	files := make(map[string]zip.FileHeader)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		rc.Close()
+		files[f.Name] = f.FileHeader
+	}
+	return files
+}
+
+func TestZipMaskModTimes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "share")
+	writeFile(t, filepath.Join(dir, "a.txt"), "a")
+	writeFile(t, filepath.Join(dir, "sub", "b.txt"), "b")
+	for _, mask := range []bool{false, true} {
+		zd, err := newZipDir(Parameters{Pathspec: dir, ZipDir: true, MaskModTimes: mask})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := newTestFileServer(t, Parameters{Pathspec: dir, ZipDownloads: true, MaskModTimes: mask})
+		for mode, w := range map[string]*httptest.ResponseRecorder{
+			"zipdir":        get(zd, zd.name),
+			"zip downloads": get(fs, "/share/?download=zip"),
+		} {
+			files := readZip(t, w.Body.Bytes())
+			for _, name := range []string{"share/a.txt", "share/sub/b.txt"} {
+				hdr, ok := files[name]
+				if !ok {
+					t.Fatalf("%s: %s is not in the archive: %v", mode, name, files)
+				}
+				recent := time.Since(hdr.Modified) < time.Hour
+				if mask && (recent || hdr.ModifiedDate != 0 || hdr.ModifiedTime != 0) {
+					t.Errorf("%s: %s is modified at %v in archive with masked times", mode, name, hdr.Modified)
+				}
+				if !mask && !recent {
+					t.Errorf("%s: %s is modified at %v", mode, name, hdr.Modified)
+				}
+			}
+		}
+	}
+}